@@ -1,31 +1,49 @@
 package main
 
 import (
+	"github.com/trussworks/truss-aws-tools/internal/aws/regions"
 	"github.com/trussworks/truss-aws-tools/internal/aws/session"
 	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
 	flag "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
 	"log"
+	"os"
+	"sync"
 	"time"
 )
 
 // The Options struct describes the command line options available.
 type Options struct {
-	Delete        bool   `short:"D" long:"delete" env:"DELETE" description:"Actually purge AMIs (runs in dryrun mode by default)."`
-	NamePrefix    string `long:"prefix" env:"NAME_PREFIX" description:"Name prefix to filter on (not affected by --invert)."`
-	RetentionDays int    `long:"days" default:"30" env:"RETENTION_DAYS" description:"Age of AMI in days before it is a candidate for removal."`
-	TagKey        string `long:"tag-key" env:"TAG_KEY" description:"Key of tag to operate on. If you specify a Key, you must also specify a Value."`
-	TagValue      string `long:"tag-value" env:"TAG_VALUE" description:"Value of tag to operate on. If you specify a Value, you must also specify a Key."`
-	Invert        bool   `short:"i" long:"invert" env:"INVERT" description:"Operate in inverted mode -- only purge AMIs that do NOT match the Tag provided."`
-	Unused        bool   `long:"unused" env:"UNUSED" description:"Only purge AMIs for which no running instances were built from."`
-	Profile       string `short:"p" long:"profile" env:"AWS_PROFILE" required:"false" description:"The AWS profile to use."`
-	Region        string `short:"r" long:"region" env:"AWS_REGION" required:"false" description:"The AWS region to use."`
-	Lambda        bool   `long:"lambda" required:"false" env:"LAMBDA" description:"Run as an AWS Lambda function."`
+	Delete        bool     `short:"D" long:"delete" env:"DELETE" description:"Actually purge AMIs (runs in dryrun mode by default)."`
+	NamePrefix    string   `long:"prefix" env:"NAME_PREFIX" description:"Name prefix to filter on (not affected by --invert)."`
+	RetentionDays int      `long:"days" default:"30" env:"RETENTION_DAYS" description:"Age of AMI in days before it is a candidate for removal."`
+	Keep          uint     `long:"keep" default:"0" env:"KEEP" description:"Number of newest AMIs in each family to keep regardless of age (0 keeps none). Only AMIs matching --prefix, the tag and any tag:Key=Value filter count."`
+	FamilyTag     string   `long:"family-tag" env:"FAMILY_TAG" description:"Tag to group AMIs into families by for --keep (defaults to the name without its timestamp suffix)."`
+	TagKey        string   `long:"tag-key" env:"TAG_KEY" description:"Key of tag to operate on. If you specify a Key, you must also specify a Value."`
+	TagValue      string   `long:"tag-value" env:"TAG_VALUE" description:"Value of tag to operate on. If you specify a Value, you must also specify a Key."`
+	Filters       []string `long:"filter" env:"FILTERS" env-delim:";" description:"Filter clause an AMI must match to be purged; may be repeated, and all clauses must match (see README)."`
+	Invert        bool     `short:"i" long:"invert" env:"INVERT" description:"Operate in inverted mode -- only purge AMIs that do NOT match the Tag provided."`
+	Unused        bool     `long:"unused" env:"UNUSED" description:"Only purge AMIs that no instances, launch templates or launch configurations use."`
+	AllowShared   bool     `long:"allow-shared" env:"ALLOW_SHARED" description:"Also purge AMIs that are public or shared with other accounts (skipped by default)."`
+	DeleteBundles bool     `long:"delete-bundles" env:"DELETE_BUNDLES" description:"Also delete the S3 manifest and parts of instance-store backed AMIs."`
+	GraceDays     int      `long:"grace-days" default:"0" env:"GRACE_DAYS" description:"Mark matching AMIs for deletion and only purge them once they've been marked this many days (0 purges right away)."`
+	MarkPrivate   bool     `long:"mark-private" env:"MARK_PRIVATE" description:"With --grace-days, also remove public access and sharing with other accounts from AMIs when marking them."`
+	ContinueOnErr bool     `long:"continue-on-error" env:"CONTINUE_ON_ERROR" description:"Keep purging other AMIs when one fails, still exiting non-zero at the end."`
+	MaxFailures   int      `long:"max-failures" default:"0" env:"MAX_FAILURES" description:"With --continue-on-error, stop once more than this many AMIs have failed (0 means no limit)."`
+	Report        string   `long:"report" env:"REPORT" choice:"json" choice:"csv" description:"Write a report of every image and snapshot acted on in this format."`
+	ReportFile    string   `long:"report-file" env:"REPORT_FILE" default:"-" description:"File to write the report to (defaults to standard output)."`
+	Profile       string   `short:"p" long:"profile" env:"AWS_PROFILE" required:"false" description:"The AWS profile to use."`
+	Region        string   `short:"r" long:"region" env:"AWS_REGION" required:"false" description:"The AWS region to use."`
+	Regions       []string `long:"regions" env:"REGIONS" env-delim:"," description:"AWS regions to sweep, or \"all\" for every enabled region; may be repeated, and each must be enabled for the account. Defaults to --region."`
+	Lambda        bool     `long:"lambda" required:"false" env:"LAMBDA" description:"Run as an AWS Lambda function."`
 }
 
 var options Options
@@ -38,6 +56,20 @@ func makeEC2Client(region, profile string) *ec2.EC2 {
 	return ec2Client
 }
 
+// We also need Auto Scaling to look up launch configurations.
+func makeAutoScalingClient(region, profile string) *autoscaling.AutoScaling {
+	sess := session.MustMakeSession(region, profile)
+	autoScalingClient := autoscaling.New(sess)
+	return autoScalingClient
+}
+
+// And S3 to delete the bundles of instance-store backed AMIs.
+func makeS3Client(region, profile string) *s3.S3 {
+	sess := session.MustMakeSession(region, profile)
+	s3Client := s3.New(sess)
+	return s3Client
+}
+
 func cleanImages() {
 	now := time.Now().UTC()
 	// We need to check to make sure that if we have a Tag Key, we also have
@@ -45,6 +77,174 @@ func cleanImages() {
 	if (options.TagKey == "") != (options.TagValue == "") {
 		logger.Fatal("must specify both a tag Key and tag Value")
 	}
+	// Without --continue-on-error we stop at the first failure, so a
+	// failure budget would never come into play.
+	if options.MaxFailures > 0 && !options.ContinueOnErr {
+		logger.Fatal("--max-failures needs --continue-on-error")
+	}
+
+	// Each --filter is a clause that has to match.
+	var filters []amiclean.Clause
+	for _, filter := range options.Filters {
+		clause, err := amiclean.ParseClause(filter)
+		if err != nil {
+			logger.Fatal("unable to parse filter",
+				zap.String("filter", filter),
+				zap.Error(err),
+			)
+		}
+		filters = append(filters, clause)
+	}
+
+	// Work out which regions we're sweeping, and sweep them all at once.
+	sess := session.MustMakeSession(options.Region, options.Profile)
+	regionList, err := regions.Resolve(sess, options.Regions)
+	if err != nil {
+		logger.Fatal("unable to get list of regions",
+			zap.Error(err),
+		)
+	}
+
+	report := &amiclean.Report{
+		Delete:  options.Delete,
+		Regions: make([]*amiclean.RegionReport, len(regionList)),
+	}
+	budget := &failureBudget{max: options.MaxFailures}
+	var wg sync.WaitGroup
+	for i, region := range regionList {
+		wg.Add(1)
+		go func(i int, region string) {
+			defer wg.Done()
+			report.Regions[i] = cleanRegion(region, now, filters, budget)
+		}(i, region)
+	}
+	wg.Wait()
+
+	// Now that every region is done, log what happened in each of them.
+	totals := summarizeRegions(report)
+
+	// Write out the report before we (possibly) bail out, since the
+	// failures are what it's most useful for.
+	if options.Report != "" {
+		err = writeReport(report)
+		if err != nil {
+			logger.Error("unable to write report",
+				zap.Error(err),
+			)
+		}
+	}
+
+	// If anything went wrong anywhere, we want to exit non-zero with
+	// everything that did, even if we carried on past it.
+	if len(totals.failedRegions) > 0 || len(totals.failedImages) > 0 {
+		err = errors.Errorf("%d images failed to purge and %d regions did not finish",
+			len(totals.failedImages), len(totals.failedRegions))
+		logger.Fatal("Failed to clean images",
+			zap.Strings("failed-regions", totals.failedRegions),
+			zap.Strings("failed-ami-ids", totals.failedImages),
+			zap.Int("ami-count", totals.purged),
+			zap.Error(err),
+		)
+	}
+	logger.Info("Finished cleaning images",
+		zap.Int("region-count", len(regionList)),
+		zap.Int("ami-count", totals.purged),
+		zap.Bool("delete", options.Delete),
+	)
+
+}
+
+// regionTotals adds up what happened across every region: how many
+// images we purged (or would have), and which images and regions failed.
+type regionTotals struct {
+	purged        int
+	failedRegions []string
+	failedImages  []string
+}
+
+// summarizeRegions logs what happened to the images in each region of
+// the report, and adds it all up.
+func summarizeRegions(report *amiclean.Report) regionTotals {
+	var totals regionTotals
+	for _, regionReport := range report.Regions {
+		imageIDs := map[amiclean.PurgeStatus][]string{}
+		for _, result := range regionReport.Images {
+			imageIDs[result.Status] = append(imageIDs[result.Status], result.ImageID)
+		}
+		purged := append(imageIDs[amiclean.PurgeStatusPurged], imageIDs[amiclean.PurgeStatusWouldPurge]...)
+		totals.purged += len(purged)
+		totals.failedImages = append(totals.failedImages, imageIDs[amiclean.PurgeStatusFailed]...)
+		totals.failedImages = append(totals.failedImages, imageIDs[amiclean.PurgeStatusPartial]...)
+		fields := []zap.Field{
+			zap.String("region", regionReport.Region),
+			zap.Strings("ami-ids", purged),
+			zap.Int("ami-count", len(purged)),
+			zap.Strings("skipped-ami-ids", imageIDs[amiclean.PurgeStatusSkipped]),
+			zap.Strings("marked-ami-ids", append(imageIDs[amiclean.PurgeStatusMarked], imageIDs[amiclean.PurgeStatusWouldMark]...)),
+			zap.Strings("pending-ami-ids", imageIDs[amiclean.PurgeStatusPending]),
+			zap.Strings("failed-ami-ids", imageIDs[amiclean.PurgeStatusFailed]),
+			zap.Strings("partial-ami-ids", imageIDs[amiclean.PurgeStatusPartial]),
+		}
+		if regionReport.Error != "" {
+			totals.failedRegions = append(totals.failedRegions, regionReport.Region)
+			logger.Error("Failed to clean images in region",
+				append(fields, zap.String("error", regionReport.Error))...,
+			)
+		} else if report.Delete {
+			logger.Info("Purged images in region", fields...)
+		} else {
+			logger.Info("Would have purged images in region", fields...)
+		}
+	}
+	return totals
+}
+
+// failureBudget counts image failures across every region, so that in
+// continue-on-error mode we can stop the whole run once there have been
+// more than max of them. A max of 0 means there's no limit.
+type failureBudget struct {
+	mu    sync.Mutex
+	max   int
+	count int
+}
+
+// fail records a failure.
+func (b *failureBudget) fail() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.count++
+}
+
+// exhausted reports whether we've had more failures than we allow.
+func (b *failureBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.max > 0 && b.count > b.max
+}
+
+// writeReport writes the report out in the format asked for, to either
+// the report file or standard output.
+func writeReport(report *amiclean.Report) error {
+	out := os.Stdout
+	if options.ReportFile != "" && options.ReportFile != "-" {
+		f, err := os.Create(options.ReportFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if options.Report == "csv" {
+		return report.WriteCSV(out)
+	}
+	return report.WriteJSON(out)
+}
+
+// cleanRegion runs the whole AMI cleaning pipeline against one region.
+func cleanRegion(region string, now time.Time, filters []amiclean.Clause, budget *failureBudget) *amiclean.RegionReport {
+	regionReport := &amiclean.RegionReport{Region: region}
+	regionLogger := logger.With(zap.String("region", region))
 
 	a := amiclean.AMIClean{
 		NamePrefix:     options.NamePrefix,
@@ -53,45 +253,97 @@ func cleanImages() {
 		Invert:         options.Invert,
 		Unused:         options.Unused,
 		ExpirationDate: now.AddDate(0, 0, -int(options.RetentionDays)),
-		Logger:         logger,
-		EC2Client:      makeEC2Client(options.Region, options.Profile),
+		KeepCount:      options.Keep,
+		FamilyTag:      options.FamilyTag,
+		Filters:        filters,
+		AllowShared:    options.AllowShared,
+		GracePeriod:    time.Duration(options.GraceDays) * 24 * time.Hour,
+		MarkPrivate:    options.MarkPrivate,
+		Now:            now,
+		Logger:         regionLogger,
+		EC2Client:      makeEC2Client(region, options.Profile),
+	}
+	// An empty tag matches any image that has at least one tag. That
+	// isn't what anyone using --filter without --tag-key wants, so we
+	// skip the tag check entirely in that case.
+	if options.TagKey == "" && len(filters) > 0 {
+		a.Tag = nil
+	}
+	if options.Unused {
+		a.AutoScalingClient = makeAutoScalingClient(region, options.Profile)
+	}
+	if options.DeleteBundles {
+		a.DeleteBundles = true
+		a.S3Client = makeS3Client(region, options.Profile)
 	}
 
-	// Get the list of images that we want to evaluate from AWS.
-	availableImages, err := a.GetImages()
+	// Get the list of images that match our criteria from AWS.
+	imagesToPurge, err := a.FindImagesToPurge()
 	if err != nil {
-		logger.Fatal("unable to get list of available images",
+		regionLogger.Error("unable to get list of available images",
 			zap.Error(err),
 		)
+		regionReport.Error = err.Error()
+		return regionReport
 	}
 
-	// For each image in the list, check to see if it matches the criteria.
-	for _, image := range availableImages.Images {
-		if a.CheckImage(image) {
-			// If it matches the criteria, we want to delete it.
-			retVal, err := a.PurgeImage(image)
-			// If we get an error, we stop the train.
-			if err != nil {
-				logger.Fatal("Failed to purge image",
-					zap.String("ami-id", *image.ImageId),
-					zap.String("failure", retVal),
-					zap.Error(err),
-				)
-			}
-			// No error, so log success (based on whether we're in
-			// delete mode or not).
-			if a.Delete {
-				logger.Info("Successfully purged image",
-					zap.String("ami-id", retVal),
-				)
-			} else {
-				logger.Info("Would have purged image",
-					zap.String("ami-id", retVal),
-				)
+	for _, image := range imagesToPurge {
+		// Another region may have used up the last of our failures.
+		if budget.exhausted() {
+			regionLogger.Error("Stopping after too many failures",
+				zap.Int("max-failures", options.MaxFailures),
+			)
+			regionReport.Error = "stopped after too many failures"
+			return regionReport
+		}
+
+		result, err := a.PurgeImage(image)
+		regionReport.Images = append(regionReport.Images, result)
+		if err != nil {
+			regionLogger.Error("Failed to purge image",
+				zap.String("ami-id", *image.ImageId),
+				zap.String("status", string(result.Status)),
+				zap.Error(err),
+			)
+			// Unless we've been told to carry on, we stop the
+			// train for this region.
+			if !options.ContinueOnErr {
+				regionReport.Error = err.Error()
+				return regionReport
 			}
+			budget.fail()
+			continue
+		}
+		// No error, so log what happened.
+		switch result.Status {
+		case amiclean.PurgeStatusPurged:
+			regionLogger.Info("Successfully purged image",
+				zap.String("ami-id", *image.ImageId),
+			)
+		case amiclean.PurgeStatusWouldPurge:
+			regionLogger.Info("Would have purged image",
+				zap.String("ami-id", *image.ImageId),
+			)
+		case amiclean.PurgeStatusSkipped:
+			regionLogger.Info("Skipped image",
+				zap.String("ami-id", *image.ImageId),
+			)
+		case amiclean.PurgeStatusMarked:
+			regionLogger.Info("Marked image for deletion",
+				zap.String("ami-id", *image.ImageId),
+			)
+		case amiclean.PurgeStatusWouldMark:
+			regionLogger.Info("Would have marked image for deletion",
+				zap.String("ami-id", *image.ImageId),
+			)
+		case amiclean.PurgeStatusPending:
+			regionLogger.Info("Image is still in its grace period",
+				zap.String("ami-id", *image.ImageId),
+			)
 		}
 	}
 
+	return regionReport
 }
 
 func lambdaHandler() {
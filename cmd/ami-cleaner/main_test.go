@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+)
+
+func TestFailureBudget(t *testing.T) {
+	tables := []struct {
+		max       int
+		failures  int
+		exhausted bool
+	}{
+		{0, 0, false},
+		{0, 100, false},
+		{3, 0, false},
+		{3, 3, false},
+		{3, 4, true},
+	}
+
+	for _, table := range tables {
+		budget := &failureBudget{max: table.max}
+		for i := 0; i < table.failures; i++ {
+			budget.fail()
+		}
+		if budget.exhausted() != table.exhausted {
+			t.Errorf("failureBudget{max: %d} after %d failures: exhausted() = %v, want %v",
+				table.max, table.failures, budget.exhausted(), table.exhausted)
+		}
+	}
+}
+
+func TestSummarizeRegions(t *testing.T) {
+	logger = zap.NewNop()
+
+	results := func(statuses ...amiclean.PurgeStatus) []*amiclean.PurgeResult {
+		var images []*amiclean.PurgeResult
+		for i, status := range statuses {
+			images = append(images, &amiclean.PurgeResult{
+				ImageID: string(status) + "-" + string(rune('a'+i)),
+				Status:  status,
+			})
+		}
+		return images
+	}
+
+	tables := []struct {
+		name    string
+		regions []*amiclean.RegionReport
+		totals  regionTotals
+	}{
+		{"no regions", nil, regionTotals{}},
+		{
+			"all purged",
+			[]*amiclean.RegionReport{
+				{Region: "us-west-2", Images: results(amiclean.PurgeStatusPurged, amiclean.PurgeStatusSkipped)},
+				{Region: "us-east-1", Images: results(amiclean.PurgeStatusPurged, amiclean.PurgeStatusMarked)},
+			},
+			regionTotals{purged: 2},
+		},
+		{
+			"dry run",
+			[]*amiclean.RegionReport{
+				{Region: "us-west-2", Images: results(amiclean.PurgeStatusWouldPurge, amiclean.PurgeStatusWouldMark)},
+				{Region: "us-east-1", Images: results(amiclean.PurgeStatusWouldPurge, amiclean.PurgeStatusWouldPurge)},
+			},
+			regionTotals{purged: 3},
+		},
+		{
+			"failed and partial images",
+			[]*amiclean.RegionReport{
+				{Region: "us-west-2", Images: results(amiclean.PurgeStatusPurged, amiclean.PurgeStatusFailed)},
+				{Region: "us-east-1", Images: results(amiclean.PurgeStatusPartial, amiclean.PurgeStatusPending)},
+			},
+			regionTotals{purged: 1, failedImages: []string{"failed-b", "partial-a"}},
+		},
+		{
+			"failed region",
+			[]*amiclean.RegionReport{
+				{Region: "us-west-2", Images: results(amiclean.PurgeStatusPurged)},
+				{Region: "us-east-1", Error: "unable to describe images"},
+				{Region: "eu-west-1", Images: results(amiclean.PurgeStatusFailed), Error: "too many failures"},
+			},
+			regionTotals{purged: 1, failedRegions: []string{"us-east-1", "eu-west-1"}, failedImages: []string{"failed-a"}},
+		},
+	}
+
+	for _, table := range tables {
+		totals := summarizeRegions(&amiclean.Report{Regions: table.regions})
+		if !reflect.DeepEqual(totals, table.totals) {
+			t.Errorf("summarizeRegions() for %s = %+v, want %+v", table.name, totals, table.totals)
+		}
+	}
+}
@@ -1,91 +1,460 @@
 package main
 
 import (
+	"github.com/trussworks/truss-aws-tools/internal/aws/regions"
 	"github.com/trussworks/truss-aws-tools/internal/aws/session"
+	"github.com/trussworks/truss-aws-tools/internal/aws/ssm"
 	"github.com/trussworks/truss-aws-tools/pkg/packerjanitor"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	flag "github.com/jessevdk/go-flags"
+	"github.com/lytics/slackhook"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"context"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Options describes the command line options available.
 type Options struct {
-	Delete    bool   `short:"D" long:"delete" env:"DELETE" description:"Actually purge AWS resources (runs in dryrun mode by default)."`
-	Lambda    bool   `long:"lambda" env:"LAMBDA" required:"false" description:"Run as an AWS Lambda function."`
-	TimeLimit int    `short:"t" long:"timelimit" default:"4" env:"TIMELIMIT" description:"Number of hours after which Packer resources should be considered abandoned."`
-	Profile   string `short:"p" long:"profile" env:"AWS_PROFILE" required:"false" description:"The AWS profile to use."`
-	Region    string `short:"r" long:"region" env:"AWS_REGION" required:"false" description:"The AWS region to use."`
+	Delete              bool     `short:"D" long:"delete" env:"DELETE" description:"Actually purge AWS resources (runs in dryrun mode by default). A dry run reports every orphaned security group a real run would mark or delete."`
+	Lambda              bool     `long:"lambda" env:"LAMBDA" required:"false" description:"Run as an AWS Lambda function."`
+	TimeLimit           int      `short:"t" long:"timelimit" default:"4" env:"TIMELIMIT" description:"Number of hours after which Packer resources should be considered abandoned. Orphaned security groups are only deleted by a run at least this long after the one that first finds them unused."`
+	WarnTimeLimit       int      `long:"warn-timelimit" default:"0" env:"WARN_TIMELIMIT" description:"Number of hours after which the owner of a Packer instance is warned in Slack that it will be terminated (0 turns warnings off). Instances past --timelimit are terminated on the run after the one that warns about them, or at twice --timelimit if they can't be marked as warned."`
+	SSMSlackWebhookURL  string   `long:"ssm-slack-webhook-url" env:"SSM_SLACK_WEBHOOK_URL" required:"false" description:"The name of the Slack Webhook Url in Parameter store, for warnings."`
+	SlackChannel        string   `long:"slack-channel" env:"SLACK_CHANNEL" required:"false" description:"The Slack channel to send warnings to."`
+	SlackEmoji          string   `long:"slack-emoji" default:":package:" env:"SLACK_EMOJI" description:"The Slack Emoji associated with the warnings."`
+	MatchTags           []string `long:"match-tag" env:"MATCH_TAGS" env-delim:"," required:"false" description:"Tag (Key=Value, or Key for any value) that marks an instance as a builder; may be repeated."`
+	MatchKeyPrefixes    []string `long:"match-key-prefix" env:"MATCH_KEY_PREFIXES" env-delim:"," required:"false" description:"Key pair name prefix (like packer_) that marks an instance as a builder; may be repeated."`
+	MatchSecurityGroups []string `long:"match-security-group" env:"MATCH_SECURITY_GROUPS" env-delim:"," required:"false" description:"Security group name pattern (like packer_*) that marks an instance as a builder; may be repeated."`
+	Workers             int      `long:"workers" default:"4" env:"WORKERS" description:"Number of instances to wait on terminating at once."`
+	SkipOrphans         bool     `long:"skip-orphans" env:"SKIP_ORPHANS" required:"false" description:"Don't sweep up Packer volumes, snapshots, network interfaces, key pairs and security groups that have no instance."`
+	Profile             string   `short:"p" long:"profile" env:"AWS_PROFILE" required:"false" description:"The AWS profile to use."`
+	Region              string   `short:"r" long:"region" env:"AWS_REGION" required:"false" description:"The AWS region to use."`
+	Regions             []string `long:"regions" env:"REGIONS" env-delim:"," description:"AWS regions to sweep, or \"all\" for every enabled region; may be repeated, and each must be enabled for the account. Defaults to --region."`
+	RoleARNs            []string `long:"role-arn" env:"ROLE_ARNS" env-delim:"," description:"ARN of a role to assume to sweep another account; may be repeated. Defaults to the account of our own credentials."`
 }
 
+// deadlineMargin is how long before our deadline we stop working, to
+// leave time to report what we didn't finish.
+const deadlineMargin = 10 * time.Second
+
 var options Options
 var logger *zap.Logger
 
-// makeEC2Client establishes our session with AWS.
-func makeEC2Client(region, profile string) *ec2.EC2 {
-	sess := session.MustMakeSession(region, profile)
-	ec2Client := ec2.New(sess)
-	return ec2Client
+// makeMatchRules builds the rules for identifying builders out of our
+// options. An instance is a builder if it matches any of them; if none
+// are given, we look for the Name tag Packer sets by default.
+func makeMatchRules() (packerjanitor.MatchRules, error) {
+	rules := packerjanitor.MatchRules{
+		KeyNamePrefixes:       options.MatchKeyPrefixes,
+		SecurityGroupPatterns: options.MatchSecurityGroups,
+	}
+	for _, rule := range options.MatchTags {
+		tag, err := packerjanitor.ParseTagRule(rule)
+		if err != nil {
+			return rules, err
+		}
+		rules.Tags = append(rules.Tags, tag)
+	}
+	return rules, rules.Validate()
+}
+
+// securityGroupIDs lists the IDs of an instance's security groups for
+// logging.
+func securityGroupIDs(instance *ec2.Instance) []string {
+	var ids []string
+	for _, group := range instance.SecurityGroups {
+		ids = append(ids, aws.StringValue(group.GroupId))
+	}
+	return ids
+}
+
+// sendWarningToSlack tells the owners of overdue Packer instances that
+// they're going to be terminated.
+func sendWarningToSlack(slackWebhookURL string, t target, instances []*ec2.Instance, now time.Time) error {
+	slack := slackhook.New(slackWebhookURL)
+	attachment := slackhook.Attachment{
+		Title: "Packer Builders Due For Termination",
+		Text: fmt.Sprintf("Packer builders running for more than %d hours; they will be terminated at %d hours, or on the next run if they're already past that, unless tagged %s",
+			options.WarnTimeLimit, options.TimeLimit, packerjanitor.KeepTag),
+		Color:  "warn",
+		Footer: "Packer Janitor",
+	}
+	if t.RoleARN != "" {
+		attachment.Footer = fmt.Sprintf("Packer Janitor (%s)", t.RoleARN)
+	}
+	for _, instance := range instances {
+		owner := packerjanitor.InstanceOwner(instance)
+		if owner == "" {
+			owner = "unknown"
+		}
+		attachment.Fields = append(attachment.Fields, slackhook.Field{
+			Title: *instance.InstanceId,
+			Value: fmt.Sprintf("Region: %s, Age: %v, Owner: %s", t.Region, now.Sub(*instance.LaunchTime).Round(time.Minute), owner),
+		})
+	}
+
+	message := &slackhook.Message{
+		Channel:   options.SlackChannel,
+		IconEmoji: options.SlackEmoji,
+	}
+	message.AddAttachment(&attachment)
+
+	err := slack.Send(message)
+	if err != nil {
+		return err
+	}
+	logger.Info("successfully sent slack message", zap.String("slack-channel", options.SlackChannel))
+	return nil
+}
+
+// warnOwners warns about overdue instances in Slack and marks them so we
+// don't warn about them again. An instance we couldn't warn about is
+// still marked, so it isn't kept past the time limit for want of a
+// warning.
+func warnOwners(p *packerjanitor.PackerClean, t target, slackWebhookURL string, instances []*ec2.Instance) {
+	err := p.WarnOwners(instances, func(instances []*ec2.Instance) error {
+		return sendWarningToSlack(slackWebhookURL, t, instances, p.Now)
+	})
+	if err != nil {
+		p.Logger.Error("failed to warn about overdue Packer instances", zap.Error(err))
+	}
+}
+
+// target is one account and region to clean up in. An empty role ARN
+// means the account our own credentials belong to.
+type target struct {
+	RoleARN   string
+	Region    string
+	ec2Client *ec2.EC2
+	err       error
 }
 
-// cleanPackerResources is where the work is being done here.
-func cleanPackerResources() {
+// String names a target for logging.
+func (t target) String() string {
+	if t.RoleARN == "" {
+		return t.Region
+	}
+	return t.RoleARN + " " + t.Region
+}
+
+// targetSummary is what happened in one target. SweepUnfinished is set
+// if we ran out of time before we'd swept up after builds that left no
+// instance behind.
+type targetSummary struct {
+	target
+	Purged          int
+	Failed          int
+	Unfinished      int
+	SweepUnfinished bool
+	Error           error
+}
+
+// makeTargets works out every combination of role and region we're
+// cleaning up in.
+func makeTargets() []target {
+	sess := session.MustMakeSession(options.Region, options.Profile)
+	return expandTargets(options.RoleARNs, func(roleARN string) ([]string, func(region string) *ec2.EC2, error) {
+		roleSess := sess
+		if roleARN != "" {
+			roleSess = sess.Copy(&aws.Config{
+				Credentials: stscreds.NewCredentials(sess, roleARN),
+			})
+		}
+		newClient := func(region string) *ec2.EC2 {
+			return ec2.New(roleSess, &aws.Config{Region: aws.String(region)})
+		}
+		regionList, err := regions.Resolve(roleSess, options.Regions)
+		return regionList, newClient, err
+	})
+}
+
+// roleResolver lists the regions to clean up in for a role, and gives us
+// a way to make an EC2 client in each of them.
+type roleResolver func(roleARN string) ([]string, func(region string) *ec2.EC2, error)
+
+// expandTargets makes a target for each region of each role. No roles
+// means just the account our own credentials belong to. If we can't list
+// the regions for a role, that role gets a single target carrying the
+// error, so that it's reported along with everything else.
+func expandTargets(roleARNs []string, resolve roleResolver) []target {
+	if len(roleARNs) == 0 {
+		roleARNs = []string{""}
+	}
+
+	var targets []target
+	for _, roleARN := range roleARNs {
+		regionList, newClient, err := resolve(roleARN)
+		if err != nil {
+			targets = append(targets, target{RoleARN: roleARN, err: err})
+			continue
+		}
+		for _, region := range regionList {
+			targets = append(targets, target{
+				RoleARN:   roleARN,
+				Region:    region,
+				ec2Client: newClient(region),
+			})
+		}
+	}
+	return targets
+}
+
+// cleanPackerResources is where the work is being done here. We clean up
+// every target at once and then report on all of them together. If ctx
+// has a deadline, as it does in Lambda, we stop a little before it so
+// that we can report what we didn't get to.
+func cleanPackerResources(ctx context.Context) {
 	now := time.Now().UTC()
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+		defer cancel()
+	}
+
+	rules, err := makeMatchRules()
+	if err != nil {
+		logger.Fatal("invalid builder match rules",
+			zap.Error(err),
+		)
+	}
+
+	// Instances get a warning before they're terminated if we've been
+	// given a soft limit.
+	var slackWebhookURL string
+	if options.WarnTimeLimit > 0 {
+		if options.WarnTimeLimit >= options.TimeLimit {
+			logger.Fatal("warn-timelimit must be less than timelimit")
+		}
+		if options.SSMSlackWebhookURL == "" || options.SlackChannel == "" {
+			logger.Fatal("warn-timelimit needs ssm-slack-webhook-url and slack-channel")
+		}
+		sess := session.MustMakeSession(options.Region, options.Profile)
+		slackWebhookURL, err = ssm.DecryptValue(sess, options.SSMSlackWebhookURL)
+		if err != nil {
+			logger.Fatal("failed to decrypt slackWebhookURL", zap.Error(err))
+		}
+	}
+
+	targets := makeTargets()
+	summaries := make([]*targetSummary, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			summaries[i] = cleanTarget(ctx, t, now, rules, slackWebhookURL)
+		}(i, t)
+	}
+	wg.Wait()
+
+	// Now that every target is done, log what happened in each of them.
+	totals := summarizeTargets(summaries)
+
+	fields := []zap.Field{
+		zap.Int("target-count", len(targets)),
+		zap.Int("purged", totals.purged),
+		zap.Int("failed", totals.failed),
+		zap.Int("unfinished", totals.unfinished),
+		zap.Bool("delete", options.Delete),
+	}
+	if totals.incomplete() {
+		logger.Fatal("Failed to clean some Packer resources",
+			append(fields,
+				zap.Strings("failed-targets", totals.failedTargets),
+				zap.Strings("unfinished-sweep-targets", totals.unfinishedSweeps),
+			)...,
+		)
+	}
+	logger.Info("Finished cleaning Packer resources", fields...)
+
+}
+
+// runTotals adds up what happened across every target.
+type runTotals struct {
+	purged           int
+	failed           int
+	unfinished       int
+	failedTargets    []string
+	unfinishedSweeps []string
+}
+
+// incomplete is whether anything, anywhere, failed or was left undone.
+func (r runTotals) incomplete() bool {
+	return r.failed > 0 || r.unfinished > 0 || len(r.failedTargets) > 0 || len(r.unfinishedSweeps) > 0
+}
+
+// summarizeTargets logs what happened in each target, and adds it all
+// up.
+func summarizeTargets(summaries []*targetSummary) runTotals {
+	var totals runTotals
+	for _, summary := range summaries {
+		totals.purged += summary.Purged
+		totals.failed += summary.Failed
+		totals.unfinished += summary.Unfinished
+		if summary.SweepUnfinished {
+			totals.unfinishedSweeps = append(totals.unfinishedSweeps, summary.String())
+		}
+		fields := []zap.Field{
+			zap.String("role-arn", summary.RoleARN),
+			zap.String("region", summary.Region),
+			zap.Int("purged", summary.Purged),
+			zap.Int("failed", summary.Failed),
+			zap.Int("unfinished", summary.Unfinished),
+			zap.Bool("sweep-unfinished", summary.SweepUnfinished),
+		}
+		if summary.Error != nil {
+			totals.failedTargets = append(totals.failedTargets, summary.String())
+			logger.Error("Failed to clean Packer resources",
+				append(fields, zap.Error(summary.Error))...,
+			)
+		} else {
+			logger.Info("Cleaned Packer resources", fields...)
+		}
+	}
+	return totals
+}
+
+// cleanTarget purges abandoned Packer instances in one target, then
+// sweeps up after builds that left no instance behind.
+func cleanTarget(ctx context.Context, t target, now time.Time, rules packerjanitor.MatchRules, slackWebhookURL string) *targetSummary {
+	summary := &targetSummary{target: t}
+	if t.err != nil {
+		summary.Error = errors.Wrap(t.err, "unable to get list of regions")
+		return summary
+	}
+
+	targetLogger := logger.With(zap.String("region", t.Region))
+	if t.RoleARN != "" {
+		targetLogger = targetLogger.With(zap.String("role-arn", t.RoleARN))
+	}
 
 	p := packerjanitor.PackerClean{
 		Delete:         options.Delete,
 		ExpirationDate: now.Add(time.Hour * time.Duration(-options.TimeLimit)),
-		Logger:         logger,
-		EC2Client:      makeEC2Client(options.Region, options.Profile),
+		Logger:         targetLogger,
+		EC2Client:      t.ec2Client,
+		Rules:          rules,
+		Now:            now,
+		Workers:        options.Workers,
+	}
+
+	// Instances we can't even mark as warned about are terminated once
+	// they're past the time limit twice over.
+	if options.WarnTimeLimit > 0 {
+		p.WarningDate = now.Add(time.Hour * time.Duration(-options.WarnTimeLimit))
+		p.UnwarnedDate = now.Add(time.Hour * time.Duration(-2*options.TimeLimit))
 	}
 
 	// First, we get the list of instances that fulfills our
-	// requirements from EC2.
-	packerInstanceList, err := p.GetPackerInstances()
+	// requirements from EC2, along with the ones we need to warn
+	// about.
+	packerInstanceList, overdueInstanceList, err := p.FindPackerInstances()
 	if err != nil {
-		logger.Fatal("unable to get list of Packer instances",
-			zap.Error(err),
-		)
+		summary.Error = errors.Wrap(err, "unable to get list of Packer instances")
+		return summary
+	}
+	if len(overdueInstanceList) > 0 {
+		warnOwners(&p, t, slackWebhookURL, overdueInstanceList)
 	}
 
-	// Now, for each instance, we want to purge it and its associated
+	// Now we want to purge the instances and their associated
 	// resources. First, let's check to see if the list is empty; if
 	// it is, we can just skip the rest.
 	if len(packerInstanceList) == 0 {
-		logger.Info("No abandoned Packer instances found.")
+		targetLogger.Info("No abandoned Packer instances found.")
 	} else {
-		for _, instance := range packerInstanceList {
-			err := p.PurgePackerResource(instance)
-			if err != nil {
-				logger.Fatal("Failed to purge Packer instance and associated resources",
-					zap.String("instance-id", *instance.InstanceId),
-					zap.String("keyname", *instance.KeyName),
-					zap.String("securitygroup-id", *instance.SecurityGroups[0].GroupId),
-					zap.Error(err),
-				)
+		for _, result := range p.PurgePackerResources(ctx, packerInstanceList) {
+			instance := result.Instance
+			fields := []zap.Field{
+				zap.String("instance-id", *instance.InstanceId),
+				zap.String("keyname", aws.StringValue(instance.KeyName)),
+				zap.Strings("securitygroup-ids", securityGroupIDs(instance)),
 			}
-			// If we didn't error out, it worked! Log our
-			// success.
-			if p.Delete {
-				logger.Info("Successfully purged Packer instance and associated resources",
-					zap.String("instance-id", *instance.InstanceId),
-					zap.String("keyname", *instance.KeyName),
-					zap.String("securitygroup-id", *instance.SecurityGroups[0].GroupId),
+			switch {
+			case result.Unfinished:
+				summary.Unfinished++
+				targetLogger.Warn("Ran out of time before purging Packer instance and associated resources",
+					append(fields, zap.Error(result.Error))...,
 				)
-			} else {
-				logger.Info("Would have purged Packer instance and associated resources",
-					zap.String("instance-id", *instance.InstanceId),
-					zap.String("keyname", *instance.KeyName),
-					zap.String("securitygroup-id", *instance.SecurityGroups[0].GroupId),
+			case result.Error != nil:
+				summary.Failed++
+				targetLogger.Error("Failed to purge Packer instance and associated resources",
+					append(fields, zap.Error(result.Error))...,
 				)
+			case p.Delete:
+				summary.Purged++
+				targetLogger.Info("Successfully purged Packer instance and associated resources", fields...)
+			default:
+				summary.Purged++
+				targetLogger.Info("Would have purged Packer instance and associated resources", fields...)
 			}
 		}
 	}
 
+	// Packer can also die without an instance to clean up after,
+	// leaving volumes, snapshots and network interfaces as well as its
+	// key pair and security group behind. The network interfaces have
+	// to go before the security groups they're in, but we sweep up the
+	// key pairs and security groups even if some of the rest couldn't
+	// be deleted; a security group that still has a network interface
+	// in it counts as in use, so it's just left for another run.
+	if options.SkipOrphans {
+		return summary
+	}
+	if ctx.Err() != nil {
+		summary.SweepUnfinished = true
+		targetLogger.Warn("Ran out of time before sweeping up orphaned Packer resources")
+		return summary
+	}
+	var sweepErrs []error
+	err = p.SweepLeftovers(ctx)
+	if err != nil {
+		sweepErrs = append(sweepErrs, errors.Wrap(err, "failed to sweep leftover Packer resources"))
+	}
+	err = p.SweepOrphans(ctx)
+	if err != nil {
+		sweepErrs = append(sweepErrs, errors.Wrap(err, "failed to sweep orphaned Packer resources"))
+	}
+	if len(sweepErrs) > 0 {
+		summary.sweepFailed(ctx, targetLogger, combineErrors(sweepErrs))
+	}
+	return summary
+}
+
+// combineErrors turns one or more errors into a single error, so that a
+// target's summary can report all of them.
+func combineErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// sweepFailed records why a sweep stopped: either we ran out of time, or
+// something went wrong.
+func (s *targetSummary) sweepFailed(ctx context.Context, targetLogger *zap.Logger, err error) {
+	if ctx.Err() == nil {
+		s.Error = err
+		return
+	}
+	s.SweepUnfinished = true
+	targetLogger.Warn("Ran out of time while sweeping up orphaned Packer resources",
+		zap.Error(err),
+	)
 }
 
 func lambdaHandler() {
@@ -111,7 +480,7 @@ func main() {
 		logger.Info("Running Lambda handler.")
 		lambdaHandler()
 	} else {
-		cleanPackerResources()
+		cleanPackerResources(context.Background())
 	}
 
 }
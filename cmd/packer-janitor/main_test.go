@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+func TestExpandTargets(t *testing.T) {
+	errDenied := errors.New("access denied")
+	newClient := func(region string) *ec2.EC2 { return nil }
+	regionsByRole := map[string][]string{
+		"":                                   {"us-west-2"},
+		"arn:aws:iam::111111111111:role/one": {"us-east-1", "us-west-2"},
+		"arn:aws:iam::222222222222:role/two": {"eu-west-1"},
+	}
+	resolve := func(roleARN string) ([]string, func(region string) *ec2.EC2, error) {
+		regionList, ok := regionsByRole[roleARN]
+		if !ok {
+			return nil, nil, errDenied
+		}
+		return regionList, newClient, nil
+	}
+
+	tables := []struct {
+		name     string
+		roleARNs []string
+		targets  []target
+	}{
+		{"no roles", nil, []target{{Region: "us-west-2"}}},
+		{
+			"several roles",
+			[]string{"arn:aws:iam::111111111111:role/one", "arn:aws:iam::222222222222:role/two"},
+			[]target{
+				{RoleARN: "arn:aws:iam::111111111111:role/one", Region: "us-east-1"},
+				{RoleARN: "arn:aws:iam::111111111111:role/one", Region: "us-west-2"},
+				{RoleARN: "arn:aws:iam::222222222222:role/two", Region: "eu-west-1"},
+			},
+		},
+		{
+			"role we can't list regions for",
+			[]string{"arn:aws:iam::333333333333:role/three", "arn:aws:iam::222222222222:role/two"},
+			[]target{
+				{RoleARN: "arn:aws:iam::333333333333:role/three", err: errDenied},
+				{RoleARN: "arn:aws:iam::222222222222:role/two", Region: "eu-west-1"},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		targets := expandTargets(table.roleARNs, resolve)
+		if !reflect.DeepEqual(targets, table.targets) {
+			t.Errorf("ERROR: expandTargets for %s;\n\texpected: %v\n\tgot: %v", table.name, table.targets, targets)
+		}
+	}
+}
+
+func TestSummarizeTargets(t *testing.T) {
+	logger = zap.NewNop()
+
+	one := target{RoleARN: "arn:aws:iam::111111111111:role/one", Region: "us-east-1"}
+	two := target{Region: "us-west-2"}
+
+	tables := []struct {
+		name       string
+		summaries  []*targetSummary
+		totals     runTotals
+		incomplete bool
+	}{
+		{"no targets", nil, runTotals{}, false},
+		{
+			"all purged",
+			[]*targetSummary{
+				{target: one, Purged: 2},
+				{target: two, Purged: 1},
+			},
+			runTotals{purged: 3},
+			false,
+		},
+		{
+			"failed and unfinished instances",
+			[]*targetSummary{
+				{target: one, Purged: 1, Failed: 1},
+				{target: two, Unfinished: 2},
+			},
+			runTotals{purged: 1, failed: 1, unfinished: 2},
+			true,
+		},
+		{
+			"failed target",
+			[]*targetSummary{
+				{target: one, Purged: 1, Error: errors.New("unable to get list of Packer instances")},
+				{target: two, Purged: 1},
+			},
+			runTotals{purged: 2, failedTargets: []string{one.String()}},
+			true,
+		},
+		{
+			"unfinished sweep",
+			[]*targetSummary{
+				{target: one},
+				{target: two, Purged: 1, SweepUnfinished: true},
+			},
+			runTotals{purged: 1, unfinishedSweeps: []string{two.String()}},
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		totals := summarizeTargets(table.summaries)
+		if !reflect.DeepEqual(totals, table.totals) {
+			t.Errorf("ERROR: summarizeTargets for %s;\n\texpected: %+v\n\tgot: %+v", table.name, table.totals, totals)
+		}
+		if totals.incomplete() != table.incomplete {
+			t.Errorf("ERROR: summarizeTargets for %s incomplete;\n\texpected: %v\n\tgot: %v", table.name, table.incomplete, totals.incomplete())
+		}
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	tables := []struct {
+		errs    []error
+		message string
+	}{
+		{[]error{errors.New("one")}, "one"},
+		{[]error{errors.New("one"), errors.New("two")}, "one; two"},
+	}
+
+	for _, table := range tables {
+		err := combineErrors(table.errs)
+		if err.Error() != table.message {
+			t.Errorf("ERROR: combineErrors(%v);\n\texpected: %v\n\tgot: %v", table.errs, table.message, err)
+		}
+	}
+}
@@ -2,26 +2,42 @@ package main
 
 import (
 	"log"
+	"os"
+	"sort"
 	"time"
 
 	"github.com/trussworks/truss-aws-tools/internal/aws/session"
 	"github.com/trussworks/truss-aws-tools/pkg/rdsclean"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 	flag "github.com/jessevdk/go-flags"
 	"go.uber.org/zap"
 )
 
 // Options are the command line options
 type Options struct {
-	DBInstanceIdentifier string `long:"db-instance-identifier" description:"The RDS database instance identifier." required:"true" env:"DB_INSTANCE_IDENTIFIER"`
-	DryRun               bool   `long:"dry-run" description:"Don't make any changes and log what would have happened." env:"DRY_RUN"`
-	Lambda               bool   `long:"lambda" description:"Run as an AWS lambda function." required:"false" env:"LAMBDA"`
-	MaxDBSnapshotCount   uint   `long:"max-snapshots" description:"The maximum number of manual snapshots allowed. This takes precedence over -retention-days." default:"0" env:"MAX_DB_SNAPSHOT_COUNT"`
-	Profile              string `long:"profile" description:"The AWS profile to use." required:"false" env:"PROFILE"`
-	Region               string `long:"region" description:"The AWS region to use." required:"false" env:"REGION"`
-	RetentionDays        uint   `long:"retention-days" description:"The maximum retention age in days." default:"30" env:"RETENTION_DAYS"`
+	DBInstanceIdentifiers []string `long:"db-instance-identifier" description:"The RDS database instance identifier, or a glob pattern matching several; may be repeated." env:"DB_INSTANCE_IDENTIFIER" env-delim:","`
+	Tags                  []string `long:"tag" description:"Tag (Key=Value, or Key for any value) selecting RDS database instances; may be repeated." env:"TAGS" env-delim:","`
+	AllInstances          bool     `long:"all-instances" description:"Clean up snapshots for every RDS database instance." env:"ALL_INSTANCES"`
+	ProtectTags           []string `long:"protect-tag" description:"Tag (Key=Value, or Key for any value) marking a DB snapshot or DB cluster snapshot that must never be deleted, like Retain=true; may be repeated." env:"PROTECT_TAGS" env-delim:","`
+	CopyRegions           []string `long:"copy-region" description:"Region DB snapshots or DB cluster snapshots are copied to; snapshots with a copy in flight there are never deleted. May be repeated." env:"COPY_REGIONS" env-delim:","`
+	Clusters              bool     `long:"clusters" description:"Clean up Aurora DB cluster snapshots, selecting clusters rather than instances." env:"CLUSTERS"`
+	DryRun                bool     `long:"dry-run" description:"Don't make any changes and log what would have happened." env:"DRY_RUN"`
+	KeepDaily             uint     `long:"keep-daily" description:"Keep the first snapshot of each of this many days. Any of the --keep options replaces --retention-days and --max-snapshots, and snapshots newer than the newest one they keep are always kept." default:"0" env:"KEEP_DAILY"`
+	KeepWeekly            uint     `long:"keep-weekly" description:"Keep the first snapshot of each of this many weeks." default:"0" env:"KEEP_WEEKLY"`
+	KeepMonthly           uint     `long:"keep-monthly" description:"Keep the first snapshot of each of this many months." default:"0" env:"KEEP_MONTHLY"`
+	KeepYearly            uint     `long:"keep-yearly" description:"Keep the first snapshot of each of this many years." default:"0" env:"KEEP_YEARLY"`
+	Lambda                bool     `long:"lambda" description:"Run as an AWS lambda function." required:"false" env:"LAMBDA"`
+	MaxDBSnapshotCount    uint     `long:"max-snapshots" description:"The maximum number of manual snapshots allowed. This takes precedence over -retention-days." default:"0" env:"MAX_DB_SNAPSHOT_COUNT"`
+	MaxSnapshotsTag       string   `long:"max-snapshots-tag" description:"Tag on a database instance that overrides --max-snapshots for it." required:"false" env:"MAX_SNAPSHOTS_TAG"`
+	Profile               string   `long:"profile" description:"The AWS profile to use." required:"false" env:"PROFILE"`
+	Region                string   `long:"region" description:"The AWS region to use." required:"false" env:"REGION"`
+	RetentionDays         uint     `long:"retention-days" description:"The maximum retention age in days." default:"30" env:"RETENTION_DAYS"`
+	RetentionDaysTag      string   `long:"retention-days-tag" description:"Tag on a database instance that overrides --retention-days for it." required:"false" env:"RETENTION_DAYS_TAG"`
+	ReportFile            string   `long:"report-file" description:"File to write a JSON report of the whole run to (- for standard output)." required:"false" env:"REPORT_FILE"`
 }
 
 var options Options
@@ -33,35 +49,303 @@ func makeRDSClient(region, profile string) *rds.RDS {
 	return rdsClient
 }
 
+// makeInstanceSelector builds the instance selector out of our options.
+func makeInstanceSelector() (rdsclean.InstanceSelector, error) {
+	selector := rdsclean.InstanceSelector{
+		IdentifierPatterns: options.DBInstanceIdentifiers,
+		All:                options.AllInstances,
+	}
+	for _, rule := range options.Tags {
+		tag, err := rdsclean.ParseTag(rule)
+		if err != nil {
+			return selector, err
+		}
+		selector.Tags = append(selector.Tags, tag)
+	}
+	return selector, selector.Validate()
+}
+
+// makePolicy builds the retention policy out of our options.
+func makePolicy() rdsclean.GFSPolicy {
+	return rdsclean.GFSPolicy{
+		Daily:   options.KeepDaily,
+		Weekly:  options.KeepWeekly,
+		Monthly: options.KeepMonthly,
+		Yearly:  options.KeepYearly,
+	}
+}
+
+// makeProtection builds the tags that protect DB snapshots and DB
+// cluster snapshots and the clients for the regions they're copied to out
+// of our options.
+func makeProtection() ([]*rds.Tag, []rdsiface.RDSAPI, error) {
+	var keepTags []*rds.Tag
+	for _, rule := range options.ProtectTags {
+		tag, err := rdsclean.ParseTag(rule)
+		if err != nil {
+			return nil, nil, err
+		}
+		keepTags = append(keepTags, tag)
+	}
+	var copyDestinationClients []rdsiface.RDSAPI
+	for _, region := range options.CopyRegions {
+		copyDestinationClients = append(copyDestinationClients, makeRDSClient(region, options.Profile))
+	}
+	return keepTags, copyDestinationClients, nil
+}
+
 func cleanRDSSnapshots() {
 	now := time.Now().UTC()
-	r := rdsclean.RDSManualSnapshotClean{
-		DBInstanceIdentifier: options.DBInstanceIdentifier,
-		DryRun:               options.DryRun,
-		ExpirationDate:       now.AddDate(0, 0, -int(options.RetentionDays)),
-		Logger:               logger,
-		MaxDBSnapshotCount:   options.MaxDBSnapshotCount,
-		RDSClient:            makeRDSClient(options.Region, options.Profile),
-	}
+	rdsClient := makeRDSClient(options.Region, options.Profile)
 
-	manualDBSnapshots, err := r.FindManualDBSnapshots()
+	selector, err := makeInstanceSelector()
 	if err != nil {
-		logger.Fatal("unable to find manual snapshots",
+		logger.Fatal("invalid database instance selection",
 			zap.Error(err))
 	}
 
-	dbSnapshotsToDelete, err := r.FindDBSnapshotsToDelete(manualDBSnapshots)
+	defaults := rdsclean.RetentionSettings{
+		RetentionDays:      options.RetentionDays,
+		MaxDBSnapshotCount: options.MaxDBSnapshotCount,
+	}
+	retentionTags := rdsclean.RetentionTags{
+		RetentionDays:      options.RetentionDaysTag,
+		MaxDBSnapshotCount: options.MaxSnapshotsTag,
+	}
+
+	// We carry on past a failure with one instance so that the others
+	// still get cleaned up, and report them all together at the end.
+	report := &rdsclean.Report{DryRun: options.DryRun}
+	keepTags, copyDestinationClients, err := makeProtection()
 	if err != nil {
-		logger.Fatal("unable to find snapshots to snapshots to delete",
+		logger.Fatal("invalid snapshot protection",
 			zap.Error(err))
 	}
+	if options.Clusters {
+		clusters, err := rdsclean.SelectDBClusters(rdsClient, selector)
+		if err != nil {
+			logger.Fatal("unable to find db clusters",
+				zap.Error(err))
+		}
+		for _, cluster := range clusters {
+			clusterReport := cleanCluster(rdsClient, cluster, now, defaults, retentionTags, keepTags, copyDestinationClients)
+			report.Instances = append(report.Instances, clusterReport)
+		}
+	} else {
+		instances, err := rdsclean.SelectDBInstances(rdsClient, selector)
+		if err != nil {
+			logger.Fatal("unable to find database instances",
+				zap.Error(err))
+		}
+		for _, instance := range instances {
+			instanceReport := cleanInstance(rdsClient, instance, now, defaults, retentionTags, keepTags, copyDestinationClients)
+			report.Instances = append(report.Instances, instanceReport)
+		}
+	}
+	if len(report.Instances) == 0 {
+		logger.Warn("no databases selected")
+	}
+
+	var failed []string
+	for _, instanceReport := range report.Instances {
+		identifier := instanceReport.DBInstanceIdentifier
+		fields := []zap.Field{zap.String("db-instance-identifier", identifier)}
+		if options.Clusters {
+			identifier = instanceReport.DBClusterIdentifier
+			fields = []zap.Field{zap.String("db-cluster-identifier", identifier)}
+		}
+		fields = append(fields,
+			zap.Uint("retention-days", instanceReport.RetentionDays),
+			zap.Uint("max-snapshots", instanceReport.MaxDBSnapshotCount),
+			zap.Int("snapshot-count", instanceReport.SnapshotCount),
+			zap.Strings("db-snapshots-to-delete", instanceReport.Snapshots),
+		)
+		var statuses []string
+		for status := range instanceReport.Unavailable {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			fields = append(fields, zap.Strings(status+"-db-snapshots", instanceReport.Unavailable[status]))
+		}
+		var reasons []string
+		for reason := range instanceReport.Protected {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fields = append(fields, zap.Strings("protected-"+reason+"-db-snapshots", instanceReport.Protected[reason]))
+		}
+		if instanceReport.Error != "" {
+			failed = append(failed, identifier)
+			logger.Error("failed to clean snapshots",
+				append(fields, zap.String("error", instanceReport.Error))...)
+		} else {
+			logger.Info("cleaned snapshots", fields...)
+		}
+	}
+
+	if options.ReportFile != "" {
+		err = writeReport(report)
+		if err != nil {
+			logger.Error("unable to write report",
+				zap.Error(err))
+		}
+	}
+
+	if len(failed) > 0 {
+		logger.Fatal("unable to clean snapshots for some databases",
+			zap.Strings("failed-identifiers", failed),
+			zap.Int("database-count", len(report.Instances)))
+	}
+	logger.Info("finished cleaning snapshots",
+		zap.Int("database-count", len(report.Instances)),
+		zap.Bool("clusters", options.Clusters),
+		zap.Bool("dry-run", options.DryRun))
+
+}
+
+// cleanInstance cleans up the manual snapshots of one instance, using
+// its own retention settings.
+func cleanInstance(rdsClient *rds.RDS, instance *rds.DBInstance, now time.Time, defaults rdsclean.RetentionSettings, retentionTags rdsclean.RetentionTags, keepTags []*rds.Tag, copyDestinationClients []rdsiface.RDSAPI) *rdsclean.InstanceReport {
+	identifier := aws.StringValue(instance.DBInstanceIdentifier)
+	instanceReport := &rdsclean.InstanceReport{
+		DBInstanceIdentifier: identifier,
+		RetentionDays:        defaults.RetentionDays,
+		MaxDBSnapshotCount:   defaults.MaxDBSnapshotCount,
+	}
+
+	settings, err := retentionTags.Settings(defaults, instance.TagList)
+	if err != nil {
+		instanceReport.Error = err.Error()
+		return instanceReport
+	}
+	instanceReport.RetentionDays = settings.RetentionDays
+	instanceReport.MaxDBSnapshotCount = settings.MaxDBSnapshotCount
+	policy := makePolicy()
+	if !policy.IsEmpty() {
+		instanceReport.Policy = &policy
+	}
+
+	r := rdsclean.RDSManualSnapshotClean{
+		DBInstanceIdentifier:   identifier,
+		DryRun:                 options.DryRun,
+		ExpirationDate:         now.AddDate(0, 0, -int(settings.RetentionDays)),
+		Logger:                 logger.With(zap.String("db-instance-identifier", identifier)),
+		MaxDBSnapshotCount:     settings.MaxDBSnapshotCount,
+		Policy:                 policy,
+		Now:                    now,
+		KeepTags:               keepTags,
+		CopyDestinationClients: copyDestinationClients,
+		RDSClient:              rdsClient,
+	}
+
+	manualDBSnapshots, err := r.ListManualDBSnapshots()
+	if err != nil {
+		instanceReport.Error = err.Error()
+		return instanceReport
+	}
+	instanceReport.SnapshotCount = len(manualDBSnapshots.Available)
+	if len(manualDBSnapshots.Unavailable) > 0 {
+		instanceReport.Unavailable = manualDBSnapshots.UnavailableIdentifiers()
+	}
+	if len(manualDBSnapshots.Protected) > 0 {
+		instanceReport.Protected = manualDBSnapshots.ProtectedIdentifiers()
+	}
+
+	dbSnapshotsToDelete, err := r.FindDBSnapshotsToDelete(manualDBSnapshots.Available)
+	if err != nil {
+		instanceReport.Error = err.Error()
+		return instanceReport
+	}
+	for _, s := range dbSnapshotsToDelete {
+		instanceReport.Snapshots = append(instanceReport.Snapshots, aws.StringValue(s.DBSnapshotIdentifier))
+	}
 
 	err = r.DeleteDBSnapshots(dbSnapshotsToDelete)
 	if err != nil {
-		logger.Fatal("unable to delete snapshots",
-			zap.Error(err))
+		instanceReport.Error = err.Error()
+	}
+	return instanceReport
+}
+
+// cleanCluster cleans up the manual snapshots of one Aurora cluster,
+// using its own retention settings.
+func cleanCluster(rdsClient *rds.RDS, cluster *rds.DBCluster, now time.Time, defaults rdsclean.RetentionSettings, retentionTags rdsclean.RetentionTags, keepTags []*rds.Tag, copyDestinationClients []rdsiface.RDSAPI) *rdsclean.InstanceReport {
+	identifier := aws.StringValue(cluster.DBClusterIdentifier)
+	instanceReport := &rdsclean.InstanceReport{
+		DBClusterIdentifier: identifier,
+		RetentionDays:       defaults.RetentionDays,
+		MaxDBSnapshotCount:  defaults.MaxDBSnapshotCount,
+	}
+
+	settings, err := retentionTags.Settings(defaults, cluster.TagList)
+	if err != nil {
+		instanceReport.Error = err.Error()
+		return instanceReport
+	}
+	instanceReport.RetentionDays = settings.RetentionDays
+	instanceReport.MaxDBSnapshotCount = settings.MaxDBSnapshotCount
+	policy := makePolicy()
+	if !policy.IsEmpty() {
+		instanceReport.Policy = &policy
+	}
+
+	r := rdsclean.RDSManualClusterSnapshotClean{
+		DBClusterIdentifier:    identifier,
+		DryRun:                 options.DryRun,
+		ExpirationDate:         now.AddDate(0, 0, -int(settings.RetentionDays)),
+		Logger:                 logger.With(zap.String("db-cluster-identifier", identifier)),
+		MaxDBSnapshotCount:     settings.MaxDBSnapshotCount,
+		Policy:                 policy,
+		Now:                    now,
+		KeepTags:               keepTags,
+		CopyDestinationClients: copyDestinationClients,
+		RDSClient:              rdsClient,
 	}
 
+	manualDBClusterSnapshots, err := r.ListManualDBClusterSnapshots()
+	if err != nil {
+		instanceReport.Error = err.Error()
+		return instanceReport
+	}
+	instanceReport.SnapshotCount = len(manualDBClusterSnapshots.Available)
+	if len(manualDBClusterSnapshots.Unavailable) > 0 {
+		instanceReport.Unavailable = manualDBClusterSnapshots.UnavailableIdentifiers()
+	}
+	if len(manualDBClusterSnapshots.Protected) > 0 {
+		instanceReport.Protected = manualDBClusterSnapshots.ProtectedIdentifiers()
+	}
+
+	dbClusterSnapshotsToDelete, err := r.FindDBClusterSnapshotsToDelete(manualDBClusterSnapshots.Available)
+	if err != nil {
+		instanceReport.Error = err.Error()
+		return instanceReport
+	}
+	for _, s := range dbClusterSnapshotsToDelete {
+		instanceReport.Snapshots = append(instanceReport.Snapshots, aws.StringValue(s.DBClusterSnapshotIdentifier))
+	}
+
+	err = r.DeleteDBClusterSnapshots(dbClusterSnapshotsToDelete)
+	if err != nil {
+		instanceReport.Error = err.Error()
+	}
+	return instanceReport
+}
+
+// writeReport writes the report out as JSON to the report file or
+// standard output.
+func writeReport(report *rdsclean.Report) error {
+	out := os.Stdout
+	if options.ReportFile != "-" {
+		f, err := os.Create(options.ReportFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return report.WriteJSON(out)
 }
 
 func lambdaHandler() {
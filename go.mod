@@ -4,14 +4,13 @@ go 1.12
 
 require (
 	github.com/aws/aws-lambda-go v1.13.2
-	github.com/aws/aws-sdk-go v1.23.22
+	github.com/aws/aws-sdk-go v1.44.200
 	github.com/ejholmes/cloudwatch v0.0.0-20170420022600-c2bae568a254
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/jstemmer/go-junit-report v0.0.0-20190106144839-af01ea7f8024 // indirect
 	github.com/lytics/slackhook v0.0.0-20160630154540-a52fd449b27d
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.10.0
-	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80 // indirect
 )
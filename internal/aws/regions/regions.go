@@ -0,0 +1,87 @@
+package regions
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/pkg/errors"
+
+	"sort"
+)
+
+// All is the value used in place of a list of regions to mean every
+// region enabled for the account.
+const All = "all"
+
+// notOptedIn is the opt-in status of a region the account hasn't
+// enabled.
+const notOptedIn = "not-opted-in"
+
+// EnabledRegions returns the names of all regions that are enabled for
+// the account, i.e. the default regions plus any that have been opted in.
+func EnabledRegions(session *session.Session) ([]string, error) {
+	return enabledRegions(ec2.New(session))
+}
+
+// enabledRegions is EnabledRegions for an EC2 client.
+func enabledRegions(ec2Client ec2iface.EC2API) ([]string, error) {
+	output, err := ec2Client.DescribeRegions(&ec2.DescribeRegionsInput{
+		AllRegions: aws.Bool(false),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to describe regions")
+	}
+
+	var regions []string
+	for _, region := range output.Regions {
+		regions = append(regions, aws.StringValue(region.RegionName))
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// Resolve turns a list of regions from the command line into the list of
+// regions to operate on. An empty list means just the session's region,
+// and a list containing All means every enabled region. Otherwise, every
+// region in the list has to exist and be enabled for the account, so
+// that a typo or a region nobody opted in to is an error rather than a
+// region we quietly fail to clean up.
+func Resolve(session *session.Session, requested []string) ([]string, error) {
+	return resolve(ec2.New(session), aws.StringValue(session.Config.Region), requested)
+}
+
+// resolve is Resolve for an EC2 client and the region it's in.
+func resolve(ec2Client ec2iface.EC2API, defaultRegion string, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return []string{defaultRegion}, nil
+	}
+
+	for _, region := range requested {
+		if region == All {
+			return enabledRegions(ec2Client)
+		}
+	}
+
+	output, err := ec2Client.DescribeRegions(&ec2.DescribeRegionsInput{
+		AllRegions: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to describe regions")
+	}
+	optInStatus := map[string]string{}
+	for _, region := range output.Regions {
+		optInStatus[aws.StringValue(region.RegionName)] = aws.StringValue(region.OptInStatus)
+	}
+	for _, region := range requested {
+		status, ok := optInStatus[region]
+		if !ok {
+			return nil, errors.Errorf("unknown region %q", region)
+		}
+		if status == notOptedIn {
+			return nil, errors.Errorf("region %q is not enabled for the account", region)
+		}
+	}
+
+	return requested, nil
+}
@@ -0,0 +1,65 @@
+package regions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// mockEC2Client knows about two default regions, one the account has
+// opted in to and one it hasn't, or fails to describe regions at all if
+// err is set.
+type mockEC2Client struct {
+	ec2iface.EC2API
+	err error
+}
+
+func (m *mockEC2Client) DescribeRegions(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	regions := []*ec2.Region{
+		{RegionName: aws.String("us-west-2"), OptInStatus: aws.String("opt-in-not-required")},
+		{RegionName: aws.String("ap-east-1"), OptInStatus: aws.String("opted-in")},
+		{RegionName: aws.String("us-east-1"), OptInStatus: aws.String("opt-in-not-required")},
+	}
+	if aws.BoolValue(input.AllRegions) {
+		regions = append(regions, &ec2.Region{RegionName: aws.String("af-south-1"), OptInStatus: aws.String(notOptedIn)})
+	}
+	return &ec2.DescribeRegionsOutput{Regions: regions}, nil
+}
+
+func TestResolve(t *testing.T) {
+	tables := []struct {
+		name      string
+		err       error
+		requested []string
+		regions   []string
+		fails     bool
+	}{
+		{"default", nil, nil, []string{"us-west-2"}, false},
+		{"all", nil, []string{All}, []string{"ap-east-1", "us-east-1", "us-west-2"}, false},
+		{"all among others", nil, []string{"us-east-1", All}, []string{"ap-east-1", "us-east-1", "us-west-2"}, false},
+		{"enabled", nil, []string{"us-east-1", "ap-east-1"}, []string{"us-east-1", "ap-east-1"}, false},
+		{"unknown", nil, []string{"us-east-1", "us-west-9"}, nil, true},
+		{"not enabled", nil, []string{"af-south-1"}, nil, true},
+		{"describe fails for all", awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil), []string{All}, nil, true},
+		{"describe fails", awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil), []string{"us-east-1"}, nil, true},
+		{"default without describing", awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil), nil, []string{"us-west-2"}, false},
+	}
+
+	for _, table := range tables {
+		regions, err := resolve(&mockEC2Client{err: table.err}, "us-west-2", table.requested)
+		if (err != nil) != table.fails {
+			t.Errorf("ERROR: %s: resolve(%v) returned error %v", table.name, table.requested, err)
+			continue
+		}
+		if !reflect.DeepEqual(regions, table.regions) {
+			t.Errorf("ERROR: %s: resolve(%v);\n\texpected: %v\n\tgot: %v", table.name, table.requested, table.regions, regions)
+		}
+	}
+}
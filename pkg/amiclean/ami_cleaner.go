@@ -2,7 +2,12 @@ package amiclean
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
 	"strings"
@@ -12,6 +17,13 @@ import (
 const (
 	// RFC8601 is the date/time format used by AWS.
 	RFC8601 = "2006-01-02T15:04:05.000Z"
+	// imagePageSize is how many images we ask for in each DescribeImages
+	// call; 1000 is the most AWS will give us in one go.
+	imagePageSize = 1000
+	// DryRun is the type of error thrown by AWS when a task fails
+	// because it was run with the DryRun option but would have
+	// otherwise succeeded.
+	DryRun = "DryRunOperation"
 )
 
 // AMIClean defines parameters for cleaning up AMIs based on a tag and
@@ -24,27 +36,138 @@ type AMIClean struct {
 	Unused         bool
 	ExpirationDate time.Time
 	Logger         *zap.Logger
-	EC2Client      *ec2.EC2
+	EC2Client      ec2iface.EC2API
+	// AutoScalingClient is used to look up launch configurations
+	// when checking whether an image is unused.
+	AutoScalingClient autoscalingiface.AutoScalingAPI
+	// UsageIndex is built on demand by CheckUnused if it is nil.
+	UsageIndex UsageIndex
+	// KeepCount is the number of newest images in each family that are
+	// kept no matter how old they are; 0 turns this off. Only images
+	// that match the filters FindImagesToPurge lists with count.
+	KeepCount uint
+	// FamilyTag is the tag used to group images into families for
+	// KeepCount. If it's empty, or an image doesn't have it, images are
+	// grouped by name with any timestamp suffix removed.
+	FamilyTag string
+	// Filters are clauses that must all match an image for it to be
+	// purged. Unlike Tag, they are not affected by Invert.
+	Filters []Clause
+	// AllowShared lets us purge images that are public or shared with
+	// other accounts; by default, they are skipped.
+	AllowShared bool
+	// DeleteBundles deletes the S3 manifest and parts of instance-store
+	// backed images when they're purged, using S3Client.
+	DeleteBundles bool
+	S3Client      s3iface.S3API
+	// SnapshotIndex is built by FindImagesToPurge. If it is set,
+	// PurgeImage won't delete snapshots other images still use.
+	SnapshotIndex SnapshotIndex
+	// GracePeriod turns on two-phase purging: images are first marked
+	// with the ScheduledDeletionTag, and only purged on a later run once
+	// they've carried the mark for this long. MarkPrivate also removes
+	// every launch permission from images when they're marked, so that
+	// neither the public nor other accounts can launch them.
+	GracePeriod time.Duration
+	MarkPrivate bool
+	// Now is the time we compare scheduled deletion dates against; if
+	// it's not set, we use the current time.
+	Now time.Time
 }
 
-// GetImages gets us all the private AMIs on our account so that they can be
-// looked through later. We have to do this here because the AWS API does not
-// allow you to search for AMIs by creation date or by *not* having a tag set to
-// a certain value, which would speed this up considerably.
-func (a *AMIClean) GetImages() (*ec2.DescribeImagesOutput, error) {
-	var output *ec2.DescribeImagesOutput
+// GetImages pages through all the private AMIs on our account and hands
+// each one to fn, so that they can be looked through without holding the
+// whole account's worth of images in memory at once. Anything we can
+// filter on server-side is pushed into the DescribeImagesInput, but we
+// still have to check the rest in CheckImage because the AWS API does not
+// allow you to search for AMIs by creation date or by *not* having a tag
+// set to a certain value. If fn returns false, we stop paging.
+func (a *AMIClean) GetImages(fn func(image *ec2.Image) bool) error {
+	return a.describeImages(a.imageFilters(), fn)
+}
 
+// describeImages pages through the images we own that match the given
+// filters, handing each one to fn until it returns false.
+func (a *AMIClean) describeImages(filters []*ec2.Filter, fn func(image *ec2.Image) bool) error {
 	input := &ec2.DescribeImagesInput{
-		Owners: []*string{aws.String("self")},
+		Owners:     []*string{aws.String("self")},
+		Filters:    filters,
+		MaxResults: aws.Int64(imagePageSize),
 	}
 
-	output, err := a.EC2Client.DescribeImages(input)
+	return a.EC2Client.DescribeImagesPages(input,
+		func(page *ec2.DescribeImagesOutput, lastPage bool) bool {
+			for _, image := range page.Images {
+				if !fn(image) {
+					return false
+				}
+			}
+			return true
+		})
+}
+
+// imageFilters builds the server-side filters for DescribeImages out of
+// our selection criteria. The name prefix can always be pushed down, but
+// the tag can only be pushed down if we aren't inverting the match, since
+// there's no way to ask for images that *don't* have a tag. Every value
+// is escaped, since we match them literally ourselves.
+func (a *AMIClean) imageFilters() []*ec2.Filter {
+	var filters []*ec2.Filter
 
-	if err != nil {
-		return nil, err
+	if a.NamePrefix != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("name"),
+			Values: []*string{aws.String(escapeFilterValue(a.NamePrefix) + "*")},
+		})
+	}
+
+	if !a.Invert && a.Tag != nil && aws.StringValue(a.Tag.Key) != "" {
+		if aws.StringValue(a.Tag.Value) != "" {
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag:" + *a.Tag.Key),
+				Values: []*string{aws.String(escapeFilterValue(*a.Tag.Value))},
+			})
+		} else {
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(escapeFilterValue(*a.Tag.Key))},
+			})
+		}
+	}
+
+	// Clauses with a single tag equality predicate can be pushed down as
+	// well, as long as we haven't already filtered on that tag.
+	for _, clause := range a.Filters {
+		if len(clause) != 1 || clause[0].Field != "tag" || clause[0].Op != "=" {
+			continue
+		}
+		name := "tag:" + clause[0].Key
+		if hasFilter(filters, name) {
+			continue
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(name),
+			Values: []*string{aws.String(escapeFilterValue(clause[0].Value))},
+		})
+	}
+
+	return filters
+}
+
+func hasFilter(filters []*ec2.Filter, name string) bool {
+	for _, filter := range filters {
+		if *filter.Name == name {
+			return true
+		}
 	}
+	return false
+}
 
-	return output, nil
+// escapeFilterValue escapes the wildcard characters EC2 filters understand
+// so that they are matched literally.
+func escapeFilterValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+	return replacer.Replace(value)
 }
 
 // MatchTags lets us see if an arbitrary tag is set to the appropriate value
@@ -71,35 +194,30 @@ func matchTags(image *ec2.Image, tag *ec2.Tag) (bool, *ec2.Tag) {
 	return false, &ec2.Tag{Key: tag.Key, Value: aws.String("not found")}
 }
 
-// CheckUnused takes an image and then checks to see if it is in use
-// as an instance. If the image is in use, it should return false; if it
-// is not in use, it should return true. Note that we're only checking for
-// AMIs we own with this account in this account; if we've shared them
-// with other accounts, we have no idea if they are being used (and
-// finding out is nontrivial, unfortunately).
-// TODO: Also check to see if we are using it for any ASG launch
-// configurations. This is more difficult because you cannot filter them
-// by AMI ID like you can with instances; you have to fetch all of them
-// and then parse through them doing the comparison, making it much more
-// onerous. :/
+// CheckUnused takes an image and then checks to see if it is in use by
+// an instance, launch template or launch configuration. If the image is
+// in use, it should return false; if it is not in use, it should return
+// true. The first call builds the UsageIndex if we haven't been given one
+// already, so that we aren't calling AWS for each image. Note that we're
+// only checking for AMIs we own with this account in this account; if
+// we've shared them with other accounts, we have no idea if they are
+// being used (and finding out is nontrivial, unfortunately).
 func (a *AMIClean) CheckUnused(image *ec2.Image) (bool, error) {
-	// First we define a filter we can use.
-	amiFilter := &ec2.Filter{
-		Name:   aws.String("image-id"),
-		Values: []*string{image.ImageId},
-	}
-	// Now, we use that filter to create an input into DescribeInstances.
-	findInstancesInput := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{amiFilter},
-	}
-	output, err := a.EC2Client.DescribeInstances(findInstancesInput)
-	if err != nil {
-		return false, err
+	if a.UsageIndex == nil {
+		index, err := a.BuildUsageIndex()
+		if err != nil {
+			return false, err
+		}
+		a.UsageIndex = index
 	}
 
-	// If the Reservations attribute in the output isn't empty, then we
-	// know something is using that AMI and we can return false.
-	if output.Reservations != nil {
+	// If the AMI is in the index, then we know something is using it
+	// and we can return false.
+	if user, ok := a.UsageIndex[*image.ImageId]; ok {
+		a.Logger.Debug("ami in use",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("used-by", user),
+		)
 		return false, nil
 	}
 
@@ -107,6 +225,88 @@ func (a *AMIClean) CheckUnused(image *ec2.Image) (bool, error) {
 	return true, nil
 }
 
+// SharedWith looks up the launch permissions on an image and returns who
+// it has been shared with: "all" if it's public, followed by any account
+// IDs, organizations and organizational units that can launch it. If the
+// image is shared with nobody, the list is empty. Deregistering an image
+// that's shared could break another account's deploys, and we have no
+// way of knowing whether they're using it.
+func (a *AMIClean) SharedWith(image *ec2.Image) ([]string, error) {
+	input := &ec2.DescribeImageAttributeInput{
+		Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+		ImageId:   image.ImageId,
+	}
+	output, err := a.EC2Client.DescribeImageAttribute(input)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedWith := launchPermissionGrantees(output.LaunchPermissions)
+	// DescribeImages already tells us if the image is public, so we
+	// make sure not to miss that.
+	if aws.BoolValue(image.Public) && (len(sharedWith) == 0 || sharedWith[0] != ec2.PermissionGroupAll) {
+		sharedWith = append([]string{ec2.PermissionGroupAll}, sharedWith...)
+	}
+	return sharedWith, nil
+}
+
+// launchPermissionGrantees turns launch permissions into a list of who
+// they grant access to, with "all" first if the image is public.
+func launchPermissionGrantees(permissions []*ec2.LaunchPermission) []string {
+	var public bool
+	var grantees []string
+	for _, permission := range permissions {
+		switch {
+		case aws.StringValue(permission.Group) == ec2.PermissionGroupAll:
+			public = true
+		case permission.UserId != nil:
+			grantees = append(grantees, *permission.UserId)
+		case permission.OrganizationArn != nil:
+			grantees = append(grantees, *permission.OrganizationArn)
+		case permission.OrganizationalUnitArn != nil:
+			grantees = append(grantees, *permission.OrganizationalUnitArn)
+		}
+	}
+	if public {
+		grantees = append([]string{ec2.PermissionGroupAll}, grantees...)
+	}
+	return grantees
+}
+
+// skipShared drops any images that are public or shared with other
+// accounts, unless AllowShared is set, in which case they're kept but we
+// log who might be relying on them.
+func (a *AMIClean) skipShared(images []*ec2.Image) []*ec2.Image {
+	var toPurge []*ec2.Image
+	for _, image := range images {
+		sharedWith, err := a.SharedWith(image)
+		if err != nil {
+			a.Logger.Error("Could not check whether image is shared",
+				zap.String("ami-id", *image.ImageId),
+				zap.Error(err),
+			)
+			// If we errored out, we want to keep the image for
+			// safety.
+			continue
+		}
+		if len(sharedWith) > 0 {
+			if !a.AllowShared {
+				a.Logger.Info("skipping ami shared with other accounts",
+					zap.String("ami-id", *image.ImageId),
+					zap.Strings("shared-with", sharedWith),
+				)
+				continue
+			}
+			a.Logger.Warn("ami is shared with other accounts",
+				zap.String("ami-id", *image.ImageId),
+				zap.Strings("shared-with", sharedWith),
+			)
+		}
+		toPurge = append(toPurge, image)
+	}
+	return toPurge
+}
+
 // CheckImage compares a given image to the purge criteria and returns true
 // if the image matches the criteria.
 func (a *AMIClean) CheckImage(image *ec2.Image) bool {
@@ -142,85 +342,275 @@ func (a *AMIClean) CheckImage(image *ec2.Image) bool {
 		}
 	}
 
-	// We want to check against the tags we're looking at.
-	match, matchedTag := matchTags(image, a.Tag)
-	// We can be a little clever here to reduce our code. If a.Invert is
-	// not the same as match, then we know either Invert was not set and
-	// we do have a match, or Invert was set and we don't have a match;
-	// either way, this is an AMI we want to mark for removal.
-	if a.Invert != match {
-		a.Logger.Debug("ami matched selection criteria",
-			zap.String("ami-id", *image.ImageId),
-			zap.String("ami-name", *image.Name),
+	fields := []zap.Field{
+		zap.String("ami-id", *image.ImageId),
+		zap.String("ami-name", *image.Name),
+		zap.String("ami-creation-date", imageCreationTime.String()),
+	}
+
+	// We want to check against the tags we're looking at, if we were
+	// given one.
+	if a.Tag != nil {
+		match, matchedTag := matchTags(image, a.Tag)
+		// We can be a little clever here to reduce our code. If
+		// a.Invert is the same as match, then we know either Invert
+		// was not set and we don't have a match, or Invert was set
+		// and we do have a match; either way, this is an AMI we
+		// want to keep.
+		if a.Invert == match {
+			return false
+		}
+		fields = append(fields,
 			zap.String("ami-tag-key", *matchedTag.Key),
 			zap.String("ami-tag-value", *matchedTag.Value),
-			zap.String("ami-creation-date", imageCreationTime.String()),
 		)
-		return true
 	}
 
-	// If we've gotten here, we know the AMI doesn't need to go.
-	return false
+	// Every filter clause has to match as well.
+	if len(a.Filters) > 0 {
+		match, matchedFilters := matchFilters(image, a.Filters)
+		if !match {
+			return false
+		}
+		fields = append(fields, zap.Strings("ami-matched-filters", matchedFilters))
+	}
+
+	// If we've gotten here, we know the AMI needs to go.
+	a.Logger.Debug("ami matched selection criteria", fields...)
+	return true
+}
+
+// PurgeStatus describes what PurgeImage did, or would have done, with an
+// image or one of its resources.
+type PurgeStatus string
+
+const (
+	// PurgeStatusPurged means the image was deregistered and its
+	// snapshots (and bundle, if asked) were deleted.
+	PurgeStatusPurged PurgeStatus = "purged"
+	// PurgeStatusWouldPurge means we're in dry run mode, and the image
+	// would otherwise have been purged.
+	PurgeStatusWouldPurge PurgeStatus = "would-purge"
+	// PurgeStatusSkipped means we didn't touch the image at all.
+	PurgeStatusSkipped PurgeStatus = "skipped"
+	// PurgeStatusFailed means we tried and failed; for an image, this
+	// means it is still registered.
+	PurgeStatusFailed PurgeStatus = "failed"
+	// PurgeStatusPartial means the image was deregistered, but some of
+	// its snapshots or its bundle could not be deleted.
+	PurgeStatusPartial PurgeStatus = "partial"
+	// PurgeStatusMarked means the image has been marked for deletion
+	// once GracePeriod is up.
+	PurgeStatusMarked PurgeStatus = "marked"
+	// PurgeStatusWouldMark means we're in dry run mode, and the image
+	// would otherwise have been marked for deletion.
+	PurgeStatusWouldMark PurgeStatus = "would-mark"
+	// PurgeStatusPending means the image is marked for deletion, but
+	// its grace period isn't up yet.
+	PurgeStatusPending PurgeStatus = "pending"
+)
+
+// The types of resource that make up an image.
+const (
+	ResourceTypeImage    = "image"
+	ResourceTypeSnapshot = "snapshot"
+	ResourceTypeBundle   = "bundle"
+)
+
+// ResourceResult records what we did, or would have done, with one of
+// the things that make up an image: the image itself, one of its
+// snapshots, or its bundle in S3.
+type ResourceResult struct {
+	Type   string      `json:"type"`
+	ID     string      `json:"id"`
+	Status PurgeStatus `json:"status"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// PurgeResult records what PurgeImage did with an image and each of its
+// resources, so that partial failures don't leave orphaned snapshots with
+// no record of them.
+type PurgeResult struct {
+	ImageID   string           `json:"ami_id"`
+	Name      string           `json:"name"`
+	Status    PurgeStatus      `json:"status"`
+	Resources []ResourceResult `json:"resources"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// add records what happened to one of the image's resources.
+func (r *PurgeResult) add(resourceType, id string, status PurgeStatus, err error) {
+	resource := ResourceResult{Type: resourceType, ID: id, Status: status}
+	if err != nil {
+		resource.Error = err.Error()
+	}
+	r.Resources = append(r.Resources, resource)
 }
 
-// PurgeImage operates on a single image, registering the image and
-// deleting any associated snapshots. We return the ID of the AMI
-// we deleted (in case that is interesting) and any errors.
-func (a *AMIClean) PurgeImage(image *ec2.Image) (string, error) {
-	// This is a circuit breaker because we currently assume all
-	// AMIs have EBS volumes. This is the case right now, but it
-	// isn't true in a more general case. More functionality would
-	// need to be added to handle instance-store backed AMIs.
-	if *image.RootDeviceType != "ebs" {
-		a.Logger.Info("image root device not EBS; will not purge",
+// PurgeImage operates on a single image, deregistering the image and
+// deleting any associated snapshots. Instance-store backed images can
+// also have their bundle deleted from S3 if DeleteBundles is set. If
+// GracePeriod is set, the image is only marked for deletion the first
+// time around, and purged once the grace period has passed. If Delete
+// isn't set, the EC2 calls are still made as dry runs so that we find
+// out about missing permissions. We return a record of what we did with
+// the image and each of its resources, along with an error if any part
+// of that failed.
+func (a *AMIClean) PurgeImage(image *ec2.Image) (*PurgeResult, error) {
+	result := &PurgeResult{
+		ImageID: *image.ImageId,
+		Name:    aws.StringValue(image.Name),
+	}
+
+	// This is a circuit breaker in case AWS ever comes up with a new
+	// kind of root device that we don't know how to clean up after.
+	rootDeviceType := aws.StringValue(image.RootDeviceType)
+	if rootDeviceType != ec2.DeviceTypeEbs && rootDeviceType != ec2.DeviceTypeInstanceStore {
+		a.Logger.Info("image root device type not supported; will not purge",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("root-device-type", rootDeviceType),
+		)
+		result.Status = PurgeStatusSkipped
+		result.add(ResourceTypeImage, *image.ImageId, PurgeStatusSkipped, nil)
+		return result, nil
+	}
+
+	// If we're purging in two phases, the image needs to have been
+	// marked for long enough before we go any further.
+	if a.GracePeriod > 0 {
+		scheduleResult, err := a.checkSchedule(image)
+		if scheduleResult != nil || err != nil {
+			return scheduleResult, err
+		}
+	}
+
+	// There may be multiple snapshots attached to a single AMI, so we
+	// need to build a list and iterate on them. Instance-store backed
+	// AMIs can have EBS volumes mapped as well.
+	snapshotIds := imageSnapshots(image)
+	deregisterInput := &ec2.DeregisterImageInput{
+		DryRun:  aws.Bool(!a.Delete),
+		ImageId: aws.String(*image.ImageId),
+	}
+	if a.Delete {
+		a.Logger.Info("deregistering ami",
 			zap.String("ami-id", *image.ImageId),
 		)
+	}
+	// In a dry run, AWS still checks that we'd be allowed to deregister
+	// the image, so permission problems show up before the real thing.
+	_, err := a.EC2Client.DeregisterImage(deregisterInput)
+	if err != nil && !isDryRun(err) {
+		err = errors.Wrap(err, "failed to deregister image")
+		result.Status = PurgeStatusFailed
+		result.Error = err.Error()
+		result.add(ResourceTypeImage, *image.ImageId, PurgeStatusFailed, err)
+		// The snapshots can't be deleted while the image is
+		// still using them, so we don't try.
+		for _, snapshot := range snapshotIds {
+			result.add(ResourceTypeSnapshot, snapshot, PurgeStatusSkipped, nil)
+		}
+		return result, err
+	}
+	if a.Delete {
+		result.add(ResourceTypeImage, *image.ImageId, PurgeStatusPurged, nil)
 	} else {
-		// There may be multiple snapshots attached to a single AMI,
-		// so we need to build a list and iterate on them.
-		var snapshotIds []*string
-		for _, blockDevice := range image.BlockDeviceMappings {
-			if blockDevice.Ebs != nil {
-				snapshotID := *blockDevice.Ebs.SnapshotId
-				snapshotIds = append(snapshotIds, &snapshotID)
-			}
+		a.Logger.Info("would deregister ami",
+			zap.String("ami-id", *image.ImageId),
+		)
+		result.add(ResourceTypeImage, *image.ImageId, PurgeStatusWouldPurge, nil)
+	}
+
+	// Now that the image is (or would be) gone, it no longer counts as
+	// using its snapshots.
+	if a.SnapshotIndex != nil {
+		a.SnapshotIndex.removeImage(image)
+	}
+
+	// Once the image is gone, we carry on past any failures so that we
+	// have a record of every snapshot that got left behind.
+	failures := 0
+	for _, snapshot := range snapshotIds {
+		// If any other image still uses the snapshot, it has to
+		// stay.
+		if users := a.SnapshotIndex[snapshot]; len(users) > 0 {
+			a.Logger.Info("keeping snapshot still used by other amis",
+				zap.String("ami-id", *image.ImageId),
+				zap.String("snapshot-id", snapshot),
+				zap.Strings("used-by", users),
+			)
+			result.add(ResourceTypeSnapshot, snapshot, PurgeStatusSkipped, nil)
+			continue
 		}
-		deregisterInput := &ec2.DeregisterImageInput{
-			DryRun:  aws.Bool(!a.Delete),
-			ImageId: aws.String(*image.ImageId),
+		deleteInput := &ec2.DeleteSnapshotInput{
+			DryRun:     aws.Bool(!a.Delete),
+			SnapshotId: aws.String(snapshot),
 		}
 		if a.Delete {
-			a.Logger.Info("deregistering ami",
+			a.Logger.Info("deleting snapshot",
+				zap.String("snapshot-id", *deleteInput.SnapshotId),
+			)
+		}
+		_, err := a.EC2Client.DeleteSnapshot(deleteInput)
+		if err != nil && !isDryRun(err) {
+			a.Logger.Error("failed to delete snapshot",
 				zap.String("ami-id", *image.ImageId),
+				zap.String("snapshot-id", *deleteInput.SnapshotId),
+				zap.Error(err),
 			)
-			_, err := a.EC2Client.DeregisterImage(deregisterInput)
-			if err != nil {
-				return "Failed to deregister image", err
-			}
+			result.add(ResourceTypeSnapshot, snapshot, PurgeStatusFailed, err)
+			failures++
+			continue
+		}
+		if a.Delete {
+			result.add(ResourceTypeSnapshot, snapshot, PurgeStatusPurged, nil)
 		} else {
-			a.Logger.Info("would deregister ami",
-				zap.String("ami-id", *image.ImageId),
+			a.Logger.Info("would delete snapshot",
+				zap.String("snapshot-id", *deleteInput.SnapshotId),
 			)
+			result.add(ResourceTypeSnapshot, snapshot, PurgeStatusWouldPurge, nil)
 		}
-		for _, snapshot := range snapshotIds {
-			deleteInput := &ec2.DeleteSnapshotInput{
-				DryRun:     aws.Bool(!a.Delete),
-				SnapshotId: aws.String(*snapshot),
-			}
-			if a.Delete {
-				a.Logger.Info("deleting snapshot",
-					zap.String("snapshot-id", *deleteInput.SnapshotId),
-				)
-				_, err := a.EC2Client.DeleteSnapshot(deleteInput)
-				if err != nil {
-					return "Failed to delete snapshot", err
-				}
-			} else {
-				a.Logger.Info("would delete snapshot",
-					zap.String("snapshot-id", *deleteInput.SnapshotId),
-				)
-			}
+	}
+
+	// Instance-store backed AMIs are stored as a bundle in S3, which
+	// deregistering the image leaves behind.
+	if rootDeviceType == ec2.DeviceTypeInstanceStore && a.DeleteBundles {
+		location := aws.StringValue(image.ImageLocation)
+		err := a.DeleteBundle(image)
+		switch {
+		case err != nil:
+			a.Logger.Error("failed to delete bundle",
+				zap.String("ami-id", *image.ImageId),
+				zap.String("image-location", location),
+				zap.Error(err),
+			)
+			result.add(ResourceTypeBundle, location, PurgeStatusFailed, err)
+			failures++
+		case a.Delete:
+			result.add(ResourceTypeBundle, location, PurgeStatusPurged, nil)
+		default:
+			result.add(ResourceTypeBundle, location, PurgeStatusWouldPurge, nil)
 		}
 	}
-	return *image.ImageId, nil
+
+	if failures > 0 {
+		err := errors.Errorf("image deregistered, but %d of its resources could not be deleted", failures)
+		result.Status = PurgeStatusPartial
+		result.Error = err.Error()
+		return result, err
+	}
+
+	if a.Delete {
+		result.Status = PurgeStatusPurged
+	} else {
+		result.Status = PurgeStatusWouldPurge
+	}
+	return result, nil
+}
+
+// isDryRun reports whether err is AWS telling us that a call made with
+// the DryRun option would otherwise have succeeded.
+func isDryRun(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == DryRun
 }
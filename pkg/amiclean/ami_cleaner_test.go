@@ -1,14 +1,177 @@
 package amiclean
 
 import (
+	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"go.uber.org/zap"
 )
 
+// We set up a mock EC2Client so that we can run the cleaner against our
+// test images and see what it would have done to them.
+type mockEC2Client struct {
+	ec2iface.EC2API
+	images    []*ec2.Image
+	instances []*ec2.Instance
+	// errors maps an image or snapshot ID to the error we return when
+	// we're asked to delete it.
+	errors map[string]error
+	// deleted records the images and snapshots we were asked to delete
+	// for real, rather than as a dry run.
+	deleted []string
+	// launchPermissions maps an image ID to who it's shared with.
+	launchPermissions map[string][]*ec2.LaunchPermission
+	// modified records the tags we put on images and the launch
+	// permissions we removed from them for real.
+	modified []string
+}
+
+// mockPageSize is kept small so that our tests page through the images.
+const mockPageSize = 2
+
+// This mocks just enough of the DescribeImages filtering for the filters
+// imageFilters pushes down to it.
+func (m *mockEC2Client) DescribeImagesPages(input *ec2.DescribeImagesInput, fn func(*ec2.DescribeImagesOutput, bool) bool) error {
+	var images []*ec2.Image
+	for _, image := range m.images {
+		if mockMatchFilters(image, input.Filters) {
+			images = append(images, image)
+		}
+	}
+
+	for start := 0; start < len(images); start += mockPageSize {
+		end := start + mockPageSize
+		if end > len(images) {
+			end = len(images)
+		}
+		if !fn(&ec2.DescribeImagesOutput{Images: images[start:end]}, end == len(images)) {
+			break
+		}
+	}
+	return nil
+}
+
+func mockMatchFilters(image *ec2.Image, filters []*ec2.Filter) bool {
+	unescape := strings.NewReplacer(`\\`, `\`, `\*`, "*", `\?`, "?")
+	for _, filter := range filters {
+		name, value := *filter.Name, *filter.Values[0]
+		switch {
+		case name == "name":
+			prefix := unescape.Replace(strings.TrimSuffix(value, "*"))
+			if !strings.HasPrefix(aws.StringValue(image.Name), prefix) {
+				return false
+			}
+		case name == "tag-key":
+			if ok, _ := matchTags(image, &ec2.Tag{Key: aws.String(unescape.Replace(value)), Value: aws.String("")}); !ok {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			tag := &ec2.Tag{Key: aws.String(strings.TrimPrefix(name, "tag:")), Value: aws.String(unescape.Replace(value))}
+			if ok, _ := matchTags(image, tag); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m *mockEC2Client) DescribeImageAttribute(input *ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+	return &ec2.DescribeImageAttributeOutput{
+		ImageId:           input.ImageId,
+		LaunchPermissions: m.launchPermissions[*input.ImageId],
+	}, nil
+}
+
+func (m *mockEC2Client) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	var changes []string
+	for _, tag := range input.Tags {
+		changes = append(changes, *tag.Key+"="+*tag.Value)
+	}
+	return &ec2.CreateTagsOutput{}, m.modify(*input.Resources[0], changes, input.DryRun)
+}
+
+func (m *mockEC2Client) ModifyImageAttribute(input *ec2.ModifyImageAttributeInput) (*ec2.ModifyImageAttributeOutput, error) {
+	changes := launchPermissionGrantees(input.LaunchPermission.Remove)
+	for i := range changes {
+		changes[i] = "-" + changes[i]
+	}
+	return &ec2.ModifyImageAttributeOutput{}, m.modify(*input.ImageId, changes, input.DryRun)
+}
+
+// modify is delete for changes we make to an image.
+func (m *mockEC2Client) modify(id string, changes []string, dryRun *bool) error {
+	if err, ok := m.errors[id]; ok {
+		return err
+	}
+	if aws.BoolValue(dryRun) {
+		return awserr.New(DryRun, "Request would have succeeded, but DryRun flag is set.", nil)
+	}
+	for _, change := range changes {
+		m.modified = append(m.modified, id+" "+change)
+	}
+	return nil
+}
+
+func (m *mockEC2Client) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	fn(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: m.instances}},
+	}, true)
+	return nil
+}
+
+func (m *mockEC2Client) DescribeLaunchTemplatesPages(input *ec2.DescribeLaunchTemplatesInput, fn func(*ec2.DescribeLaunchTemplatesOutput, bool) bool) error {
+	fn(&ec2.DescribeLaunchTemplatesOutput{}, true)
+	return nil
+}
+
+func (m *mockEC2Client) DeregisterImage(input *ec2.DeregisterImageInput) (*ec2.DeregisterImageOutput, error) {
+	return &ec2.DeregisterImageOutput{}, m.delete(*input.ImageId, input.DryRun)
+}
+
+func (m *mockEC2Client) DeleteSnapshot(input *ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error) {
+	return &ec2.DeleteSnapshotOutput{}, m.delete(*input.SnapshotId, input.DryRun)
+}
+
+// delete fails if we've been told to, and otherwise behaves the way AWS
+// does with and without the DryRun option.
+func (m *mockEC2Client) delete(id string, dryRun *bool) error {
+	if err, ok := m.errors[id]; ok {
+		return err
+	}
+	if aws.BoolValue(dryRun) {
+		return awserr.New(DryRun, "Request would have succeeded, but DryRun flag is set.", nil)
+	}
+	m.deleted = append(m.deleted, id)
+	return nil
+}
+
+type mockAutoScalingClient struct {
+	autoscalingiface.AutoScalingAPI
+}
+
+func (m *mockAutoScalingClient) DescribeLaunchConfigurationsPages(input *autoscaling.DescribeLaunchConfigurationsInput, fn func(*autoscaling.DescribeLaunchConfigurationsOutput, bool) bool) error {
+	fn(&autoscaling.DescribeLaunchConfigurationsOutput{}, true)
+	return nil
+}
+
+// imageIDs is a helper for comparing lists of images.
+func imageIDs(images []*ec2.Image) []string {
+	var ids []string
+	for _, image := range images {
+		ids = append(ids, *image.ImageId)
+	}
+	return ids
+}
+
 var newMasterImage = &ec2.Image{
 	Name:         aws.String("masterimage-alpha"),
 	Description:  aws.String("New Master Image"),
@@ -135,18 +298,24 @@ func TestCheckImage(t *testing.T) {
 		Tag           *ec2.Tag
 		Invert        bool
 		RetentionDays int
+		Unused        bool
 		resultSet     []bool
 	}{
-		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, false, 1, []bool{false, false, false, false, false}},
-		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")}, false, 30, []bool{false, false, true, false, false}},
-		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")}, false, 1, []bool{false, true, true, false, false}},
-		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, 1, []bool{false, true, true, true, true}},
-		{testImages, "devimage", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, 1, []bool{false, true, true, false, false}},
-		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, false, 1, []bool{false, false, false, true, false}},
-		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, true, 0, []bool{true, true, true, false, true}},
-		{testImages, "notagimage", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, true, 0, []bool{false, false, false, false, true}},
-		{testImages, "", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, false, 1, []bool{false, true, true, true, false}},
-		{testImages, "testimage", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, false, 10, []bool{false, false, false, false, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, false, 1, false, []bool{false, false, false, false, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")}, false, 30, false, []bool{false, false, true, false, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")}, false, 1, false, []bool{false, true, true, false, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, 1, false, []bool{false, true, true, true, true}},
+		{testImages, "devimage", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, 1, false, []bool{false, true, true, false, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, false, 1, false, []bool{false, false, false, true, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, true, 0, false, []bool{true, true, true, false, true}},
+		{testImages, "notagimage", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, true, 0, false, []bool{false, false, false, false, true}},
+		{testImages, "", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, false, 1, false, []bool{false, true, true, true, false}},
+		{testImages, "testimage", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, false, 10, false, []bool{false, false, false, false, false}},
+		// The first three images are used by an instance, a launch
+		// template and an Auto Scaling group's launch configuration.
+		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, true, 0, true, []bool{false, false, false, false, true}},
+		{testImages, "", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, false, 1, true, []bool{false, false, false, true, false}},
+		{testImages, "devimage", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, 1, true, []bool{false, false, false, false, false}},
 	}
 
 	for _, table := range tables {
@@ -154,19 +323,22 @@ func TestCheckImage(t *testing.T) {
 			NamePrefix:     table.NamePrefix,
 			Tag:            table.Tag,
 			Invert:         table.Invert,
+			Unused:         table.Unused,
 			Delete:         false,
 			ExpirationDate: now.AddDate(0, 0, -int(table.RetentionDays)),
 			Logger:         logger,
 			EC2Client:      nil,
+			UsageIndex:     testUsageIndex(),
 		}
 
 		for index, image := range testImages {
 			if a.CheckImage(image) != table.resultSet[index] {
-				t.Errorf("ERROR: prefix: %v, tag: %v, invert %v, retention %v, image %v;\n\texpected: %v\n\tgot: %v",
+				t.Errorf("ERROR: prefix: %v, tag: %v, invert %v, retention %v, unused %v, image %v;\n\texpected: %v\n\tgot: %v",
 					table.NamePrefix,
 					table.Tag,
 					table.Invert,
 					table.RetentionDays,
+					table.Unused,
 					*image.Name,
 					table.resultSet,
 					a.CheckImage(image),
@@ -177,7 +349,7 @@ func TestCheckImage(t *testing.T) {
 }
 
 // Testing the image purging is a little difficult; since we're not acting
-// on the actual AWS API, it's probably not going to error out. But this
+// on the actual AWS API, the mock isn't going to error out. But this
 // does at least ensure that we're acting on the right types and parsing
 // things correctly, and we can see the log messages from the tests.
 func TestPurgeImage(t *testing.T) {
@@ -187,13 +359,762 @@ func TestPurgeImage(t *testing.T) {
 		Delete:         false,
 		ExpirationDate: now.AddDate(0, 0, -1),
 		Logger:         logger,
-		EC2Client:      nil,
+		EC2Client:      &mockEC2Client{},
 	}
 
-	for _, image := range testImages {
-		deletedImage, err := a.PurgeImage(image)
-		if !(deletedImage == *image.ImageId && err == nil) {
+	// Since we're in dry run mode, every image (including the
+	// instance-store backed one) should come back as one we would purge,
+	// along with each of its snapshots.
+	resourceCounts := []int{2, 3, 2, 1, 2}
+	for index, image := range testImages {
+		result, err := a.PurgeImage(image)
+		if !(result.Status == PurgeStatusWouldPurge && err == nil) {
 			t.Errorf("ERROR: PurgeImage test failed for %v", *image.ImageId)
 		}
+		if len(result.Resources) != resourceCounts[index] {
+			t.Errorf("ERROR: PurgeImage for %v recorded %d resources, expected %d",
+				*image.ImageId, len(result.Resources), resourceCounts[index])
+		}
+		for _, resource := range result.Resources {
+			if resource.Status != PurgeStatusWouldPurge {
+				t.Errorf("ERROR: PurgeImage for %v recorded %v %v as %v",
+					*image.ImageId, resource.Type, resource.ID, resource.Status)
+			}
+		}
+	}
+
+	// An image with a root device we don't know about should be skipped
+	// rather than reported as purged.
+	unknownImage := &ec2.Image{
+		ImageId:        aws.String("ami-66666666666666666"),
+		RootDeviceType: aws.String("quantum-foam"),
+	}
+	result, err := a.PurgeImage(unknownImage)
+	if !(result.Status == PurgeStatusSkipped && err == nil) {
+		t.Errorf("ERROR: PurgeImage did not skip %v; got %v, %v", *unknownImage.ImageId, result.Status, err)
+	}
+}
+
+// Whichever way DescribeImages is paged through, we need to make sure
+// the filters we push down to it line up with our selection criteria.
+func TestImageFilters(t *testing.T) {
+	tables := []struct {
+		NamePrefix string
+		Tag        *ec2.Tag
+		Invert     bool
+		Filter     string
+		result     map[string]string
+	}{
+		{"", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, false, "", map[string]string{}},
+		{"devimage", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, false, "", map[string]string{"name": "devimage*"}},
+		{"dev*image?", &ec2.Tag{Key: aws.String(""), Value: aws.String("")}, true, "", map[string]string{"name": `dev\*image\?*`}},
+		{"", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, false, "", map[string]string{"tag:Branch": "master"}},
+		{"devimage", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, "", map[string]string{"name": "devimage*"}},
+		{"", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("")}, false, "", map[string]string{"tag-key": "Branch"}},
+		{"", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String(`feature/*\?`)}, false, "", map[string]string{"tag:Branch": `feature/\*\\\?`}},
+		{"", &ec2.Tag{Key: aws.String("Team?"), Value: aws.String("")}, false, "", map[string]string{"tag-key": `Team\?`}},
+		{"", nil, false, "tag:Branch=release-*", map[string]string{"tag:Branch": `release-\*`}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			NamePrefix: table.NamePrefix,
+			Tag:        table.Tag,
+			Invert:     table.Invert,
+			Logger:     logger,
+		}
+		if table.Filter != "" {
+			clause, err := ParseClause(table.Filter)
+			if err != nil {
+				t.Fatalf("ERROR: ParseClause(%q) threw error: %v", table.Filter, err)
+			}
+			a.Filters = []Clause{clause}
+		}
+
+		filters := a.imageFilters()
+		got := map[string]string{}
+		for _, filter := range filters {
+			got[*filter.Name] = *filter.Values[0]
+		}
+		if !reflect.DeepEqual(got, table.result) {
+			t.Errorf("ERROR: prefix: %v, tag: %v, invert %v;\n\texpected: %v\n\tgot: %v",
+				table.NamePrefix,
+				table.Tag,
+				table.Invert,
+				table.result,
+				got,
+			)
+		}
+	}
+}
+
+// testUsageIndex is a usage index built out of canned API output, in
+// which newMasterImage is used by an instance, newishDevImage by a launch
+// template, and oldDevImage by the launch configuration of an Auto
+// Scaling group.
+func testUsageIndex() UsageIndex {
+	index := UsageIndex{}
+	index.addReservations([]*ec2.Reservation{
+		{Instances: []*ec2.Instance{
+			{InstanceId: aws.String("i-11111111111111111"), ImageId: newMasterImage.ImageId},
+		}},
+	})
+	index.addLaunchTemplateVersions([]*ec2.LaunchTemplateVersion{
+		{
+			LaunchTemplateId: aws.String("lt-11111111111111111"),
+			VersionNumber:    aws.Int64(1),
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+				ImageId: newishDevImage.ImageId,
+			},
+		},
+		{
+			LaunchTemplateId:   aws.String("lt-11111111111111111"),
+			VersionNumber:      aws.Int64(2),
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{},
+		},
+		{
+			LaunchTemplateId: aws.String("lt-22222222222222222"),
+			VersionNumber:    aws.Int64(1),
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+				ImageId: aws.String("resolve:ssm:/golden/ami"),
+			},
+		},
+	})
+	index.addLaunchConfigurations([]*autoscaling.LaunchConfiguration{
+		{LaunchConfigurationName: aws.String("old-lc"), ImageId: oldDevImage.ImageId},
+	})
+	return index
+}
+
+// Here we make sure that CheckUnused consults the usage index rather than
+// going out to AWS.
+func TestCheckUnused(t *testing.T) {
+	a := AMIClean{
+		Unused:     true,
+		Logger:     logger,
+		EC2Client:  nil,
+		UsageIndex: testUsageIndex(),
+	}
+
+	resultSet := []bool{false, false, false, true, true}
+	for i, image := range testImages {
+		unused, err := a.CheckUnused(image)
+		if err != nil {
+			t.Errorf("ERROR: CheckUnused threw error for %v: %v", *image.ImageId, err)
+		}
+		if unused != resultSet[i] {
+			t.Errorf("ERROR: CheckUnused for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				resultSet[i],
+				unused,
+			)
+		}
+	}
+}
+
+func TestImageFamily(t *testing.T) {
+	tables := []struct {
+		name      string
+		tags      []*ec2.Tag
+		familyTag string
+		result    string
+	}{
+		{"devimage-alpha", nil, "", "name:devimage-alpha"},
+		{"app-1554066297", nil, "", "name:app"},
+		{"app-v2-1554066297", nil, "", "name:app-v2"},
+		{"app_2019-03-31T21-04-57Z", nil, "", "name:app"},
+		{"app 2019.03.31", nil, "", "name:app"},
+		{"app-1554066297", []*ec2.Tag{{Key: aws.String("Application"), Value: aws.String("web")}}, "Application", "tag:web"},
+		{"app-1554066297", []*ec2.Tag{{Key: aws.String("Branch"), Value: aws.String("master")}}, "Application", "name:app"},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{FamilyTag: table.familyTag, Logger: logger}
+		family := a.ImageFamily(&ec2.Image{Name: aws.String(table.name), Tags: table.tags})
+		if family != table.result {
+			t.Errorf("ERROR: ImageFamily for name %v, family tag %v;\n\texpected: %v\n\tgot: %v",
+				table.name,
+				table.familyTag,
+				table.result,
+				family,
+			)
+		}
+	}
+}
+
+func TestApplyKeepCount(t *testing.T) {
+	a := AMIClean{
+		KeepCount: 1,
+		Logger:    logger,
+	}
+
+	// Both dev images are in the same family once we group them by tag,
+	// so only the older of the two should go. The other images are each
+	// the newest (and only) member of their family.
+	a.FamilyTag = "Branch"
+	families := map[string][]imageRef{}
+	for _, image := range testImages {
+		family := a.ImageFamily(image)
+		created, _ := time.Parse(RFC8601, *image.CreationDate)
+		families[family] = append(families[family], imageRef{id: *image.ImageId, created: created})
+	}
+
+	resultSet := []*ec2.Image{oldDevImage}
+	testSet := a.applyKeepCount(testImages, families)
+	if !reflect.DeepEqual(testSet, resultSet) {
+		t.Errorf("ERROR: applyKeepCount;\n\texpected: %v\n\tgot: %v", resultSet, testSet)
+	}
+}
+
+func TestParseClause(t *testing.T) {
+	tables := []struct {
+		filter string
+		result string
+		valid  bool
+	}{
+		{"tag:Branch", "tag:Branch", true},
+		{"!tag:Branch", "!tag:Branch", true},
+		{"tag:Branch=master", "tag:Branch=master", true},
+		{"tag:Branch==master", "tag:Branch=master", true},
+		{"tag:Branch!=master", "tag:Branch!=master", true},
+		{"name~^app-[0-9]+", "name~^app-[0-9]+", true},
+		{"description!~Old", "description!~Old", true},
+		{"tag:Team=infra || tag:Team=ops", "tag:Team=infra || tag:Team=ops", true},
+		{"", "", false},
+		{"tag:", "", false},
+		{"name", "", false},
+		{"!tag:Branch=master", "", false},
+		{"owner=me", "", false},
+		{"name~[", "", false},
+	}
+
+	for _, table := range tables {
+		clause, err := ParseClause(table.filter)
+		if (err == nil) != table.valid {
+			t.Errorf("ERROR: ParseClause(%q) error: %v, expected valid: %v", table.filter, err, table.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var parts []string
+		for _, predicate := range clause {
+			parts = append(parts, predicate.String())
+		}
+		if got := strings.Join(parts, " || "); got != table.result {
+			t.Errorf("ERROR: ParseClause(%q);\n\texpected: %v\n\tgot: %v", table.filter, table.result, got)
+		}
+	}
+}
+
+func TestCheckImageFilters(t *testing.T) {
+	tables := []struct {
+		filters   []string
+		resultSet []bool
+	}{
+		{[]string{"tag:Branch!=master", "name~^devimage-"}, []bool{false, true, true, false, false}},
+		{[]string{"tag:Foozle"}, []bool{false, false, true, true, false}},
+		{[]string{"!tag:Branch"}, []bool{false, false, false, false, true}},
+		{[]string{"tag:Foozle=Fizzbin || tag:Foozle=Whatsit", "description~Old"}, []bool{false, false, true, false, false}},
+		{[]string{"tag:Branch=development || name~^notag"}, []bool{false, true, true, false, true}},
+	}
+
+	for _, table := range tables {
+		var clauses []Clause
+		for _, filter := range table.filters {
+			clause, err := ParseClause(filter)
+			if err != nil {
+				t.Fatalf("ERROR: ParseClause(%q) threw error: %v", filter, err)
+			}
+			clauses = append(clauses, clause)
+		}
+		a := AMIClean{
+			Filters:        clauses,
+			ExpirationDate: now,
+			Logger:         logger,
+		}
+
+		for index, image := range testImages {
+			if a.CheckImage(image) != table.resultSet[index] {
+				t.Errorf("ERROR: filters: %v, image %v;\n\texpected: %v\n\tgot: %v",
+					table.filters,
+					*image.Name,
+					table.resultSet,
+					a.CheckImage(image),
+				)
+			}
+		}
+	}
+}
+
+func TestLaunchPermissionGrantees(t *testing.T) {
+	tables := []struct {
+		permissions []*ec2.LaunchPermission
+		result      []string
+	}{
+		{nil, nil},
+		{[]*ec2.LaunchPermission{{Group: aws.String("all")}}, []string{"all"}},
+		{
+			[]*ec2.LaunchPermission{
+				{UserId: aws.String("111111111111")},
+				{OrganizationArn: aws.String("arn:aws:organizations::111111111111:organization/o-abcdefghij")},
+				{Group: aws.String("all")},
+			},
+			[]string{"all", "111111111111", "arn:aws:organizations::111111111111:organization/o-abcdefghij"},
+		},
+	}
+
+	for _, table := range tables {
+		grantees := launchPermissionGrantees(table.permissions)
+		if !reflect.DeepEqual(grantees, table.result) {
+			t.Errorf("ERROR: launchPermissionGrantees;\n\texpected: %v\n\tgot: %v", table.result, grantees)
+		}
+	}
+}
+
+func TestParseBundleLocation(t *testing.T) {
+	tables := []struct {
+		location string
+		bucket   string
+		key      string
+		valid    bool
+	}{
+		{"my-bucket/images/app.manifest.xml", "my-bucket", "images/app.manifest.xml", true},
+		{"my-bucket/app.manifest.xml", "my-bucket", "app.manifest.xml", true},
+		{"123456789012/my-ebs-image", "", "", false},
+		{"my-bucket", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, table := range tables {
+		bucket, key, err := parseBundleLocation(table.location)
+		if (err == nil) != table.valid || bucket != table.bucket || key != table.key {
+			t.Errorf("ERROR: parseBundleLocation(%q) = %q, %q, %v", table.location, bucket, key, err)
+		}
+	}
+}
+
+func TestBundleKeys(t *testing.T) {
+	manifest := []byte(`<?xml version="1.0" ?>
+<manifest>
+  <version>2007-10-10</version>
+  <image>
+    <name>app</name>
+    <parts count="2">
+      <part index="0"><filename>app.part.0</filename><digest algorithm="SHA1">abc</digest></part>
+      <part index="1"><filename>app.part.1</filename><digest algorithm="SHA1">def</digest></part>
+    </parts>
+  </image>
+</manifest>`)
+
+	keys, err := bundleKeys("images/app.manifest.xml", manifest)
+	if err != nil {
+		t.Fatalf("ERROR: bundleKeys threw error: %v", err)
+	}
+	resultSet := []string{"images/app.manifest.xml", "images/app.part.0", "images/app.part.1"}
+	if !reflect.DeepEqual(keys, resultSet) {
+		t.Errorf("ERROR: bundleKeys;\n\texpected: %v\n\tgot: %v", resultSet, keys)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	report := &Report{
+		Delete: true,
+		Regions: []*RegionReport{
+			{
+				Region: "us-west-2",
+				Images: []*PurgeResult{
+					{
+						ImageID: "ami-11111111111111111",
+						Name:    "masterimage-alpha",
+						Status:  PurgeStatusPartial,
+						Error:   "image deregistered, but 1 of its resources could not be deleted",
+						Resources: []ResourceResult{
+							{Type: ResourceTypeImage, ID: "ami-11111111111111111", Status: PurgeStatusPurged},
+							{Type: ResourceTypeSnapshot, ID: "snap-11111111111111111", Status: PurgeStatusFailed, Error: "InvalidSnapshot.InUse"},
+						},
+					},
+				},
+			},
+			{Region: "us-east-1", Error: "RequestExpired"},
+		},
+	}
+
+	var csvOut strings.Builder
+	if err := report.WriteCSV(&csvOut); err != nil {
+		t.Fatalf("ERROR: WriteCSV threw error: %v", err)
+	}
+	wantCSV := `region,ami_id,name,image_status,resource_type,resource_id,resource_status,error
+us-west-2,ami-11111111111111111,masterimage-alpha,partial,image,ami-11111111111111111,purged,
+us-west-2,ami-11111111111111111,masterimage-alpha,partial,snapshot,snap-11111111111111111,failed,InvalidSnapshot.InUse
+us-east-1,,,,,,,RequestExpired
+`
+	if csvOut.String() != wantCSV {
+		t.Errorf("ERROR: WriteCSV;\n\texpected: %v\n\tgot: %v", wantCSV, csvOut.String())
+	}
+
+	var jsonOut strings.Builder
+	if err := report.WriteJSON(&jsonOut); err != nil {
+		t.Fatalf("ERROR: WriteJSON threw error: %v", err)
+	}
+	var roundTrip Report
+	if err := json.Unmarshal([]byte(jsonOut.String()), &roundTrip); err != nil {
+		t.Fatalf("ERROR: WriteJSON wrote invalid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(&roundTrip, report) {
+		t.Errorf("ERROR: WriteJSON did not round trip;\n\texpected: %+v\n\tgot: %+v", report, &roundTrip)
+	}
+}
+
+// A copy of oldDevImage that was registered from the same snapshot.
+var copiedDevImage = &ec2.Image{
+	Name:         aws.String("devimage-bravo-copy"),
+	Description:  aws.String("Copied Dev Image"),
+	ImageId:      aws.String("ami-77777777777777777"),
+	CreationDate: aws.String("2019-03-02T21:04:57.000Z"),
+	BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+		{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs: &ec2.EbsBlockDevice{
+				SnapshotId: aws.String("snap-33333333333333333"),
+			},
+		},
+	},
+	RootDeviceType: aws.String("ebs"),
+}
+
+func TestPurgeImageSharedSnapshot(t *testing.T) {
+	index := SnapshotIndex{}
+	for _, image := range append(testImages, copiedDevImage) {
+		index.addImage(image)
+	}
+	a := AMIClean{
+		Delete:        false,
+		Logger:        logger,
+		EC2Client:     &mockEC2Client{},
+		SnapshotIndex: index,
+	}
+
+	// The copy still uses the snapshot, so purging the original should
+	// leave it alone.
+	result, err := a.PurgeImage(oldDevImage)
+	if err != nil {
+		t.Fatalf("ERROR: PurgeImage threw error: %v", err)
+	}
+	if result.Resources[1].Status != PurgeStatusSkipped {
+		t.Errorf("ERROR: PurgeImage did not skip shared snapshot; got %v", result.Resources[1].Status)
+	}
+
+	// Once the original is gone, purging the copy should take the
+	// snapshot with it.
+	result, err = a.PurgeImage(copiedDevImage)
+	if err != nil {
+		t.Fatalf("ERROR: PurgeImage threw error: %v", err)
+	}
+	if result.Resources[1].Status != PurgeStatusWouldPurge {
+		t.Errorf("ERROR: PurgeImage did not purge unshared snapshot; got %v", result.Resources[1].Status)
+	}
+	if _, ok := index["snap-33333333333333333"]; ok {
+		t.Errorf("ERROR: snapshot still in index after both images were purged: %v", index)
+	}
+}
+
+func TestPurgeImageGracePeriod(t *testing.T) {
+	markedImage := func(value string) *ec2.Image {
+		return &ec2.Image{
+			Name:         aws.String("markedimage"),
+			ImageId:      aws.String("ami-88888888888888888"),
+			CreationDate: aws.String("2019-03-01T21:04:57.000Z"),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(ScheduledDeletionTag), Value: aws.String(value)},
+			},
+			RootDeviceType: aws.String("ebs"),
+		}
+	}
+
+	tables := []struct {
+		image  *ec2.Image
+		status PurgeStatus
+	}{
+		{oldDevImage, PurgeStatusWouldMark},
+		{markedImage("2019-04-15"), PurgeStatusPending},
+		{markedImage("2019-04-01"), PurgeStatusWouldPurge},
+		{markedImage("2019-03-15"), PurgeStatusWouldPurge},
+		{markedImage("keep"), PurgeStatusSkipped},
+		// Someone removed the ScheduledDeletionTag we put on this
+		// one.
+		{&ec2.Image{
+			Name:         aws.String("unmarkedimage"),
+			ImageId:      aws.String("ami-99999999999999999"),
+			CreationDate: aws.String("2019-03-01T21:04:57.000Z"),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(MarkedTag), Value: aws.String("2019-03-01")},
+			},
+			RootDeviceType: aws.String("ebs"),
+		}, PurgeStatusSkipped},
+	}
+
+	a := AMIClean{
+		Delete:      false,
+		GracePeriod: 14 * 24 * time.Hour,
+		Now:         now,
+		Logger:      logger,
+		EC2Client:   &mockEC2Client{},
+	}
+
+	for _, table := range tables {
+		result, err := a.PurgeImage(table.image)
+		if err != nil {
+			t.Errorf("ERROR: PurgeImage threw error for %v: %v", table.image.Tags, err)
+			continue
+		}
+		if result.Status != table.status {
+			t.Errorf("ERROR: PurgeImage with tags %v;\n\texpected: %v\n\tgot: %v",
+				table.image.Tags,
+				table.status,
+				result.Status,
+			)
+		}
+	}
+}
+
+// Here we mark a public image that's also shared with another account,
+// for real and as a dry run, and check that MarkPrivate takes away every
+// launch permission it has.
+func TestMarkImage(t *testing.T) {
+	tables := []struct {
+		Delete      bool
+		MarkPrivate bool
+		status      PurgeStatus
+		modified    []string
+	}{
+		{false, true, PurgeStatusWouldMark, nil},
+		{true, false, PurgeStatusMarked, []string{
+			"ami-22222222222222222 " + ScheduledDeletionTag + "=2019-04-15",
+			"ami-22222222222222222 " + MarkedTag + "=2019-04-01",
+		}},
+		{true, true, PurgeStatusMarked, []string{
+			"ami-22222222222222222 " + ScheduledDeletionTag + "=2019-04-15",
+			"ami-22222222222222222 " + MarkedTag + "=2019-04-01",
+			"ami-22222222222222222 -all",
+			"ami-22222222222222222 -123456789012",
+		}},
+	}
+
+	for _, table := range tables {
+		m := &mockEC2Client{
+			launchPermissions: map[string][]*ec2.LaunchPermission{
+				"ami-22222222222222222": {
+					{Group: aws.String(ec2.PermissionGroupAll)},
+					{UserId: aws.String("123456789012")},
+				},
+			},
+		}
+		a := AMIClean{
+			Delete:      table.Delete,
+			GracePeriod: 14 * 24 * time.Hour,
+			MarkPrivate: table.MarkPrivate,
+			Now:         now,
+			Logger:      logger,
+			EC2Client:   m,
+		}
+
+		result, err := a.MarkImage(newishDevImage)
+		if err != nil {
+			t.Errorf("ERROR: MarkImage with delete %v, private %v threw error: %v", table.Delete, table.MarkPrivate, err)
+			continue
+		}
+		if result.Status != table.status {
+			t.Errorf("ERROR: MarkImage with delete %v, private %v;\n\texpected: %v\n\tgot: %v",
+				table.Delete, table.MarkPrivate, table.status, result.Status)
+		}
+		if !reflect.DeepEqual(m.modified, table.modified) {
+			t.Errorf("ERROR: MarkImage with delete %v, private %v modified;\n\texpected: %v\n\tgot: %v",
+				table.Delete, table.MarkPrivate, table.modified, m.modified)
+		}
+	}
+}
+
+// Here we run the whole selection against the mock, so that the filters
+// we push down to DescribeImages and the checks we do ourselves have to
+// agree with each other.
+func TestFindImagesToPurge(t *testing.T) {
+	tables := []struct {
+		NamePrefix    string
+		Tag           *ec2.Tag
+		Invert        bool
+		Unused        bool
+		RetentionDays int
+		result        []*ec2.Image
+	}{
+		{"", nil, false, false, 1, []*ec2.Image{newishDevImage, oldDevImage, noEbsImage, noTagImage}},
+		{"devimage", nil, false, false, 1, []*ec2.Image{newishDevImage, oldDevImage}},
+		{"", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")}, false, false, 30, []*ec2.Image{oldDevImage}},
+		{"", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, false, 1, []*ec2.Image{newishDevImage, oldDevImage, noEbsImage, noTagImage}},
+		{"devimage", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, false, 1, []*ec2.Image{newishDevImage, oldDevImage}},
+		{"", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("")}, false, false, 1, []*ec2.Image{oldDevImage, noEbsImage}},
+		{"", nil, false, true, 1, []*ec2.Image{newishDevImage, noEbsImage, noTagImage}},
+		{"", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")}, false, true, 1, []*ec2.Image{newishDevImage}},
+		{"", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, true, true, 0, []*ec2.Image{newMasterImage, newishDevImage, noTagImage}},
+		{"testimage", nil, false, false, 1, nil},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			NamePrefix:     table.NamePrefix,
+			Tag:            table.Tag,
+			Invert:         table.Invert,
+			Unused:         table.Unused,
+			Delete:         false,
+			ExpirationDate: now.AddDate(0, 0, -table.RetentionDays),
+			Logger:         logger,
+			EC2Client: &mockEC2Client{
+				images: testImages,
+				instances: []*ec2.Instance{
+					{InstanceId: aws.String("i-11111111111111111"), ImageId: oldDevImage.ImageId},
+				},
+			},
+			AutoScalingClient: &mockAutoScalingClient{},
+		}
+
+		images, err := a.FindImagesToPurge()
+		if err != nil {
+			t.Errorf("ERROR: FindImagesToPurge threw error: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(imageIDs(images), imageIDs(table.result)) {
+			t.Errorf("ERROR: prefix: %v, tag: %v, invert %v, unused %v, retention %v;\n\texpected: %v\n\tgot: %v",
+				table.NamePrefix,
+				table.Tag,
+				table.Invert,
+				table.Unused,
+				table.RetentionDays,
+				imageIDs(table.result),
+				imageIDs(images),
+			)
+		}
+	}
+}
+
+// Here we share some of the images that would otherwise be purged, and
+// check that they're skipped unless AllowShared is set.
+func TestFindImagesToPurgeShared(t *testing.T) {
+	launchPermissions := map[string][]*ec2.LaunchPermission{
+		*oldDevImage.ImageId: {{UserId: aws.String("111111111111")}},
+		*noEbsImage.ImageId:  {{Group: aws.String(ec2.PermissionGroupAll)}},
+	}
+
+	tables := []struct {
+		AllowShared bool
+		result      []*ec2.Image
+	}{
+		{false, []*ec2.Image{newishDevImage, noTagImage}},
+		{true, []*ec2.Image{newishDevImage, oldDevImage, noEbsImage, noTagImage}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			AllowShared:    table.AllowShared,
+			Delete:         false,
+			ExpirationDate: now.AddDate(0, 0, -1),
+			Logger:         logger,
+			EC2Client: &mockEC2Client{
+				images:            testImages,
+				launchPermissions: launchPermissions,
+			},
+			AutoScalingClient: &mockAutoScalingClient{},
+		}
+
+		sharedWith, err := a.SharedWith(oldDevImage)
+		if err != nil {
+			t.Errorf("ERROR: SharedWith threw error: %v", err)
+		}
+		if expected := []string{"111111111111"}; !reflect.DeepEqual(sharedWith, expected) {
+			t.Errorf("ERROR: SharedWith;\n\texpected: %v\n\tgot: %v", expected, sharedWith)
+		}
+
+		images, err := a.FindImagesToPurge()
+		if err != nil {
+			t.Errorf("ERROR: FindImagesToPurge threw error: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(imageIDs(images), imageIDs(table.result)) {
+			t.Errorf("ERROR: FindImagesToPurge with allow shared %v;\n\texpected: %v\n\tgot: %v",
+				table.AllowShared,
+				imageIDs(table.result),
+				imageIDs(images),
+			)
+		}
+	}
+}
+
+// Here we make AWS fail the calls PurgeImage makes, both for real and in
+// a dry run, and check that each failure ends up in the result.
+func TestPurgeImageFailures(t *testing.T) {
+	unauthorized := awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+	inUse := awserr.New("InvalidSnapshot.InUse", "The snapshot is currently in use.", nil)
+
+	tables := []struct {
+		Delete    bool
+		errors    map[string]error
+		status    PurgeStatus
+		resources []PurgeStatus
+		deleted   []string
+	}{
+		// A dry run that AWS says would have worked.
+		{false, nil, PurgeStatusWouldPurge,
+			[]PurgeStatus{PurgeStatusWouldPurge, PurgeStatusWouldPurge, PurgeStatusWouldPurge},
+			nil},
+		// A dry run without permission to deregister the image.
+		{false, map[string]error{"ami-22222222222222222": unauthorized}, PurgeStatusFailed,
+			[]PurgeStatus{PurgeStatusFailed, PurgeStatusSkipped, PurgeStatusSkipped},
+			nil},
+		// A dry run without permission to delete one of the snapshots.
+		{false, map[string]error{"snap-22222222222222223": unauthorized}, PurgeStatusPartial,
+			[]PurgeStatus{PurgeStatusWouldPurge, PurgeStatusWouldPurge, PurgeStatusFailed},
+			nil},
+		{true, nil, PurgeStatusPurged,
+			[]PurgeStatus{PurgeStatusPurged, PurgeStatusPurged, PurgeStatusPurged},
+			[]string{"ami-22222222222222222", "snap-22222222222222222", "snap-22222222222222223"}},
+		// If the image can't be deregistered, its snapshots are left
+		// alone.
+		{true, map[string]error{"ami-22222222222222222": unauthorized}, PurgeStatusFailed,
+			[]PurgeStatus{PurgeStatusFailed, PurgeStatusSkipped, PurgeStatusSkipped},
+			nil},
+		// If one snapshot can't be deleted, we still delete the rest.
+		{true, map[string]error{"snap-22222222222222222": inUse}, PurgeStatusPartial,
+			[]PurgeStatus{PurgeStatusPurged, PurgeStatusFailed, PurgeStatusPurged},
+			[]string{"ami-22222222222222222", "snap-22222222222222223"}},
+	}
+
+	for _, table := range tables {
+		m := &mockEC2Client{errors: table.errors}
+		a := AMIClean{
+			Delete:    table.Delete,
+			Logger:    logger,
+			EC2Client: m,
+		}
+
+		result, err := a.PurgeImage(newishDevImage)
+		failed := table.status == PurgeStatusFailed || table.status == PurgeStatusPartial
+		if (err != nil) != failed {
+			t.Errorf("ERROR: PurgeImage with delete %v, errors %v returned error %v", table.Delete, table.errors, err)
+		}
+		if result.Status != table.status {
+			t.Errorf("ERROR: PurgeImage with delete %v, errors %v;\n\texpected: %v\n\tgot: %v",
+				table.Delete, table.errors, table.status, result.Status)
+		}
+		var resources []PurgeStatus
+		for _, resource := range result.Resources {
+			resources = append(resources, resource.Status)
+		}
+		if !reflect.DeepEqual(resources, table.resources) {
+			t.Errorf("ERROR: PurgeImage with delete %v, errors %v recorded resources;\n\texpected: %v\n\tgot: %v",
+				table.Delete, table.errors, table.resources, resources)
+		}
+		if !reflect.DeepEqual(m.deleted, table.deleted) {
+			t.Errorf("ERROR: PurgeImage with delete %v, errors %v deleted;\n\texpected: %v\n\tgot: %v",
+				table.Delete, table.errors, table.deleted, m.deleted)
+		}
 	}
 }
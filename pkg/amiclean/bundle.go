@@ -0,0 +1,125 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"encoding/xml"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// maxDeleteObjects is the most keys S3 will delete in one DeleteObjects
+// call.
+const maxDeleteObjects = 1000
+
+// bundleManifest is the part of an instance-store bundle's manifest that
+// we care about: the names of the parts, which live next to it in S3.
+type bundleManifest struct {
+	Parts []string `xml:"image>parts>part>filename"`
+}
+
+// parseBundleLocation splits an image's ImageLocation, which looks like
+// "bucket/path/to/image.manifest.xml", into its bucket and manifest key.
+func parseBundleLocation(location string) (string, string, error) {
+	parts := strings.SplitN(location, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || !strings.HasSuffix(parts[1], ".manifest.xml") {
+		return "", "", errors.Errorf("image location %q is not an S3 bundle manifest", location)
+	}
+	return parts[0], parts[1], nil
+}
+
+// bundleKeys returns the keys of the manifest and every part it lists.
+func bundleKeys(manifestKey string, manifest []byte) ([]string, error) {
+	var m bundleManifest
+	if err := xml.Unmarshal(manifest, &m); err != nil {
+		return nil, errors.Wrap(err, "unable to parse bundle manifest")
+	}
+
+	keys := []string{manifestKey}
+	dir := path.Dir(manifestKey)
+	for _, part := range m.Parts {
+		if dir == "." {
+			keys = append(keys, part)
+		} else {
+			keys = append(keys, dir+"/"+part)
+		}
+	}
+	return keys, nil
+}
+
+// DeleteBundle deletes the S3 manifest and parts an instance-store backed
+// image was registered from.
+func (a *AMIClean) DeleteBundle(image *ec2.Image) error {
+	bucket, manifestKey, err := parseBundleLocation(aws.StringValue(image.ImageLocation))
+	if err != nil {
+		return err
+	}
+
+	// The manifest is the only place the parts are listed, so we need to
+	// read it before we can delete anything.
+	output, err := a.S3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(manifestKey),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to get bundle manifest")
+	}
+	defer output.Body.Close()
+	manifest, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return errors.Wrap(err, "unable to read bundle manifest")
+	}
+	keys, err := bundleKeys(manifestKey, manifest)
+	if err != nil {
+		return err
+	}
+
+	if !a.Delete {
+		a.Logger.Info("would delete bundle",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("bucket", bucket),
+			zap.Strings("keys", keys),
+		)
+		return nil
+	}
+
+	a.Logger.Info("deleting bundle",
+		zap.String("ami-id", *image.ImageId),
+		zap.String("bucket", bucket),
+		zap.Strings("keys", keys),
+	)
+	for start := 0; start < len(keys); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		deleteOutput, err := a.S3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return errors.Wrap(err, "unable to delete bundle objects")
+		}
+		// DeleteObjects reports failures per key rather than as
+		// an error.
+		if len(deleteOutput.Errors) > 0 {
+			failure := deleteOutput.Errors[0]
+			return errors.Errorf("unable to delete %d bundle objects, first was %s: %s",
+				len(deleteOutput.Errors),
+				aws.StringValue(failure.Key),
+				aws.StringValue(failure.Message),
+			)
+		}
+	}
+
+	return nil
+}
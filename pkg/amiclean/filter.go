@@ -0,0 +1,188 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+
+	"regexp"
+	"strings"
+)
+
+// Predicate is a single test against an image: a tag being present or
+// absent, a tag being equal or not equal to a value, or a tag, the name or
+// the description matching (or not matching) a regular expression.
+type Predicate struct {
+	// Field is "tag", "name" or "description".
+	Field string
+	// Key is the tag key when Field is "tag".
+	Key string
+	// Op is one of "exists", "absent", "=", "!=", "~" or "!~".
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// Clause is a list of predicates, any one of which has to match for the
+// clause to match. An image has to match every clause in AMIClean.Filters
+// to be purged, so together they make an AND of ORs.
+type Clause []*Predicate
+
+// ParseClause parses a filter clause. A clause is one or more predicates
+// separated by "||", and each predicate looks like one of these:
+//
+//	tag:Key          the tag is set
+//	!tag:Key         the tag is not set
+//	tag:Key=Value    the tag is set to Value
+//	tag:Key!=Value   the tag is not set to Value (or is not set at all)
+//	name~regexp      the name matches the regular expression
+//	name!~regexp     the name does not match the regular expression
+//
+// The "~" and "!~" operators also work on tags and on "description", and
+// "=" and "!=" also work on the name and description.
+func ParseClause(s string) (Clause, error) {
+	var clause Clause
+	for _, part := range strings.Split(s, "||") {
+		predicate, err := parsePredicate(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		clause = append(clause, predicate)
+	}
+	return clause, nil
+}
+
+func parsePredicate(s string) (*Predicate, error) {
+	if s == "" {
+		return nil, errors.New("empty filter predicate")
+	}
+
+	// A leading "!" is only used to test for a tag not being set.
+	if strings.HasPrefix(s, "!") {
+		if !strings.HasPrefix(s, "!tag:") || strings.ContainsAny(s, "=~") {
+			return nil, errors.Errorf("invalid filter predicate %q: only a bare tag can be negated with !", s)
+		}
+		return &Predicate{Field: "tag", Key: strings.TrimPrefix(s, "!tag:"), Op: "absent"}, nil
+	}
+
+	// Split the field from the operator and value at the first "=" or
+	// "~", pulling a "!" in front of it into the operator.
+	p := &Predicate{}
+	field := s
+	if i := strings.IndexAny(s, "=~"); i >= 0 {
+		field = s[:i]
+		p.Op = s[i : i+1]
+		p.Value = s[i+1:]
+		if strings.HasSuffix(field, "!") {
+			field = strings.TrimSuffix(field, "!")
+			p.Op = "!" + p.Op
+		} else if p.Op == "=" && strings.HasPrefix(p.Value, "=") {
+			// Allow "==" as well as "=".
+			p.Value = strings.TrimPrefix(p.Value, "=")
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(field, "tag:"):
+		p.Field = "tag"
+		p.Key = strings.TrimPrefix(field, "tag:")
+		if p.Key == "" {
+			return nil, errors.Errorf("invalid filter predicate %q: missing tag key", s)
+		}
+		if p.Op == "" {
+			p.Op = "exists"
+		}
+	case field == "name" || field == "description":
+		p.Field = field
+		if p.Op == "" {
+			return nil, errors.Errorf("invalid filter predicate %q: %s needs an operator", s, field)
+		}
+	default:
+		return nil, errors.Errorf("invalid filter predicate %q: unknown field %q", s, field)
+	}
+
+	if p.Op == "~" || p.Op == "!~" {
+		re, err := regexp.Compile(p.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid filter predicate %q", s)
+		}
+		p.re = re
+	}
+
+	return p, nil
+}
+
+// String gives back the predicate in the form ParseClause takes.
+func (p *Predicate) String() string {
+	switch p.Op {
+	case "exists":
+		return "tag:" + p.Key
+	case "absent":
+		return "!tag:" + p.Key
+	}
+	if p.Field == "tag" {
+		return "tag:" + p.Key + p.Op + p.Value
+	}
+	return p.Field + p.Op + p.Value
+}
+
+// Match reports whether the image satisfies the predicate.
+func (p *Predicate) Match(image *ec2.Image) bool {
+	var value string
+	var found bool
+
+	switch p.Field {
+	case "tag":
+		for _, tag := range image.Tags {
+			if aws.StringValue(tag.Key) == p.Key {
+				value, found = aws.StringValue(tag.Value), true
+				break
+			}
+		}
+	case "name":
+		value, found = aws.StringValue(image.Name), true
+	case "description":
+		value, found = aws.StringValue(image.Description), true
+	}
+
+	switch p.Op {
+	case "exists":
+		return found
+	case "absent":
+		return !found
+	case "=":
+		return found && value == p.Value
+	case "!=":
+		return !found || value != p.Value
+	case "~":
+		return found && p.re.MatchString(value)
+	case "!~":
+		return !found || !p.re.MatchString(value)
+	}
+	return false
+}
+
+// Match reports whether any predicate in the clause matches the image,
+// and if so, which one did.
+func (c Clause) Match(image *ec2.Image) (bool, *Predicate) {
+	for _, predicate := range c {
+		if predicate.Match(image) {
+			return true, predicate
+		}
+	}
+	return false, nil
+}
+
+// matchFilters checks the image against every clause, returning whether
+// they all matched and the predicates that did the matching.
+func matchFilters(image *ec2.Image, clauses []Clause) (bool, []string) {
+	var matched []string
+	for _, clause := range clauses {
+		match, predicate := clause.Match(image)
+		if !match {
+			return false, nil
+		}
+		matched = append(matched, predicate.String())
+	}
+	return true, matched
+}
@@ -0,0 +1,73 @@
+package amiclean
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+)
+
+// Report is the record of a whole ami-cleaner run, so that cleanups can
+// be audited afterwards and any failures picked out.
+type Report struct {
+	Delete  bool            `json:"delete"`
+	Regions []*RegionReport `json:"regions"`
+}
+
+// RegionReport records what happened to each image we tried to purge in
+// a region, and the error that stopped us, if there was one.
+type RegionReport struct {
+	Region string         `json:"region"`
+	Images []*PurgeResult `json:"images"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// reportCSVHeader is the header row for WriteCSV.
+var reportCSVHeader = []string{
+	"region", "ami_id", "name", "image_status", "resource_type", "resource_id", "resource_status", "error",
+}
+
+// WriteJSON writes the report out as a single JSON document.
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteCSV writes the report out as CSV, with a row for every resource
+// of every image. A region that failed before we got to any images gets
+// a row of its own with just the error.
+func (r *Report) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(reportCSVHeader); err != nil {
+		return err
+	}
+
+	for _, region := range r.Regions {
+		if len(region.Images) == 0 && region.Error != "" {
+			row := []string{region.Region, "", "", "", "", "", "", region.Error}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+		for _, image := range region.Images {
+			for _, resource := range image.Resources {
+				row := []string{
+					region.Region,
+					image.ImageID,
+					image.Name,
+					string(image.Status),
+					resource.Type,
+					resource.ID,
+					string(resource.Status),
+					resource.Error,
+				}
+				if err := writer.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,175 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+
+	"regexp"
+	"sort"
+	"time"
+)
+
+// familySuffix matches the timestamp or build number that image pipelines
+// usually tack onto the end of an AMI name, such as "-1554066297" or
+// "-2019-03-31T21-04-57Z". Each piece has to follow a separator, so that
+// something like "app-v2" keeps its version.
+var familySuffix = regexp.MustCompile(`(?:[-_. ][0-9]+(?:T[0-9]+)?Z?)+$`)
+
+// imageRef is the little bit of an image we need to hang on to in order to
+// work out which images are the newest in their family.
+type imageRef struct {
+	id      string
+	created time.Time
+}
+
+// ImageFamily returns the key we group an image under for KeepCount. This
+// is the value of FamilyTag if it's set on the image; otherwise, it is the
+// image name with any timestamp suffix removed.
+func (a *AMIClean) ImageFamily(image *ec2.Image) string {
+	if a.FamilyTag != "" {
+		for _, tag := range image.Tags {
+			if aws.StringValue(tag.Key) == a.FamilyTag {
+				return "tag:" + aws.StringValue(tag.Value)
+			}
+		}
+	}
+
+	return "name:" + familySuffix.ReplaceAllString(aws.StringValue(image.Name), "")
+}
+
+// FindImagesToPurge pages through our images and returns the ones that
+// match the purge criteria. If KeepCount is set, the newest KeepCount
+// images in each family are left out, much like MaxDBSnapshotCount does
+// for RDS snapshots. Families are made up of the images we list, which
+// imageFilters narrows down to the ones matching NamePrefix, Tag (unless
+// Invert is set) and any single tag equality clause, so only those count
+// toward KeepCount; they count whether or not they're old enough to be
+// purged, or match the rest of the criteria. Images shared with other
+// accounts are left out as well, unless AllowShared is set. Along the
+// way, we build the SnapshotIndex PurgeImage uses to avoid deleting
+// shared snapshots.
+func (a *AMIClean) FindImagesToPurge() ([]*ec2.Image, error) {
+	var candidates []*ec2.Image
+	families := map[string][]imageRef{}
+
+	// The snapshot index needs every image we own, so we can only build
+	// it in this pass if we aren't filtering on the server side.
+	filters := a.imageFilters()
+	snapshots := SnapshotIndex{}
+
+	// Images we marked for deletion on an earlier run that no longer
+	// match the criteria should lose their mark. Images a team has opted
+	// out (by setting the tag to something other than a date) keep it.
+	var unmark []*ec2.Image
+
+	err := a.describeImages(filters, func(image *ec2.Image) bool {
+		if len(filters) == 0 {
+			snapshots.addImage(image)
+		}
+		if a.KeepCount > 0 {
+			family := a.ImageFamily(image)
+			created, _ := time.Parse(RFC8601, aws.StringValue(image.CreationDate))
+			families[family] = append(families[family], imageRef{
+				id:      *image.ImageId,
+				created: created,
+			})
+		}
+		if a.CheckImage(image) {
+			candidates = append(candidates, image)
+		} else if _, _, ok := scheduledDeletion(image); ok {
+			unmark = append(unmark, image)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(filters) > 0 {
+		snapshots, err = a.BuildSnapshotIndex()
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.SnapshotIndex = snapshots
+
+	if a.KeepCount > 0 {
+		candidates = a.applyKeepCount(candidates, families)
+	}
+
+	// Checking whether an image is shared takes an API call per image,
+	// so we leave it until we've narrowed things down as far as we can.
+	toPurge := a.skipShared(candidates)
+
+	if a.GracePeriod > 0 {
+		a.unmarkSpared(unmark, candidates, toPurge)
+	}
+
+	return toPurge, nil
+}
+
+// unmarkSpared removes our mark from images that didn't match the criteria
+// this time around, as well as candidates that were kept because they
+// were among the newest in their family or were shared.
+func (a *AMIClean) unmarkSpared(unmark, candidates, toPurge []*ec2.Image) {
+	purging := map[string]bool{}
+	for _, image := range toPurge {
+		purging[*image.ImageId] = true
+	}
+	for _, image := range candidates {
+		if _, _, ok := scheduledDeletion(image); ok && !purging[*image.ImageId] {
+			unmark = append(unmark, image)
+		}
+	}
+
+	for _, image := range unmark {
+		if err := a.UnmarkImage(image); err != nil {
+			a.Logger.Error("Could not unmark image",
+				zap.String("ami-id", *image.ImageId),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// applyKeepCount drops any of the candidates that are among the newest
+// KeepCount images of their family.
+func (a *AMIClean) applyKeepCount(candidates []*ec2.Image, families map[string][]imageRef) []*ec2.Image {
+	kept := newestInFamilies(families, a.KeepCount)
+
+	var toPurge []*ec2.Image
+	for _, image := range candidates {
+		if kept[*image.ImageId] {
+			a.Logger.Info("keeping ami as one of the newest in its family",
+				zap.String("ami-id", *image.ImageId),
+				zap.String("ami-family", a.ImageFamily(image)),
+				zap.Uint("keep-count", a.KeepCount),
+			)
+			continue
+		}
+		toPurge = append(toPurge, image)
+	}
+
+	return toPurge
+}
+
+// newestInFamilies returns the set of image IDs that are among the newest
+// keep images in each family.
+func newestInFamilies(families map[string][]imageRef, keep uint) map[string]bool {
+	kept := map[string]bool{}
+
+	for _, refs := range families {
+		// Sort newest first, the same way sortDBSnapshots does.
+		sort.Slice(refs, func(i, j int) bool {
+			return refs[i].created.After(refs[j].created)
+		})
+		for i, ref := range refs {
+			if uint(i) >= keep {
+				break
+			}
+			kept[ref.id] = true
+		}
+	}
+
+	return kept
+}
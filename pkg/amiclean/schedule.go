@@ -0,0 +1,206 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+
+	"time"
+)
+
+const (
+	// ScheduledDeletionTag is the tag we mark images with when
+	// GracePeriod is set. Its value is the date the image can be
+	// deleted on.
+	ScheduledDeletionTag = "ami-cleaner:scheduled-deletion"
+	// ScheduledDeletionFormat is the format of the date in the
+	// ScheduledDeletionTag.
+	ScheduledDeletionFormat = "2006-01-02"
+	// MarkedTag is the tag we put on images alongside the
+	// ScheduledDeletionTag, and leave there, so that we can tell an
+	// image whose ScheduledDeletionTag someone removed from one we've
+	// never marked. Its value is the date we marked the image on.
+	MarkedTag = "ami-cleaner:marked"
+)
+
+// scheduledDeletion looks for our mark on an image. It returns whether
+// the image is marked, and if so, the date it can be deleted on. If the
+// ScheduledDeletionTag has been set to something that isn't a date, or
+// removed from an image we marked, ok is false; this is how teams opt an
+// image out of deletion for good.
+func scheduledDeletion(image *ec2.Image) (marked bool, date time.Time, ok bool) {
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) == ScheduledDeletionTag {
+			parsed, err := time.Parse(ScheduledDeletionFormat, aws.StringValue(tag.Value))
+			return true, parsed, err == nil
+		}
+	}
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) == MarkedTag {
+			return true, time.Time{}, false
+		}
+	}
+	return false, time.Time{}, false
+}
+
+// checkSchedule decides what to do with an image when GracePeriod is set.
+// It returns a result if the image shouldn't be purged yet (because we've
+// just marked it, it's still in its grace period, or a team has opted it
+// out), or nil if the grace period is over and the image can go.
+func (a *AMIClean) checkSchedule(image *ec2.Image) (*PurgeResult, error) {
+	result := &PurgeResult{
+		ImageID: *image.ImageId,
+		Name:    aws.StringValue(image.Name),
+	}
+
+	marked, date, ok := scheduledDeletion(image)
+	switch {
+	case !marked:
+		return a.MarkImage(image)
+	case !ok:
+		a.Logger.Info("ami opted out of scheduled deletion",
+			zap.String("ami-id", *image.ImageId),
+		)
+		result.Status = PurgeStatusSkipped
+	case a.now().Before(date):
+		a.Logger.Info("ami scheduled for deletion",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("scheduled-deletion", date.Format(ScheduledDeletionFormat)),
+		)
+		result.Status = PurgeStatusPending
+	default:
+		return nil, nil
+	}
+
+	result.add(ResourceTypeImage, *image.ImageId, result.Status, nil)
+	return result, nil
+}
+
+// MarkImage tags an image with the date it can be deleted on, which is
+// GracePeriod from now, and makes it private if MarkPrivate is set. This
+// is the first half of the two-phase purge. As with PurgeImage, if Delete
+// isn't set the EC2 calls are still made as dry runs.
+func (a *AMIClean) MarkImage(image *ec2.Image) (*PurgeResult, error) {
+	result := &PurgeResult{
+		ImageID: *image.ImageId,
+		Name:    aws.StringValue(image.Name),
+	}
+	today := a.now().Format(ScheduledDeletionFormat)
+	date := a.now().Add(a.GracePeriod).Format(ScheduledDeletionFormat)
+
+	if a.Delete {
+		a.Logger.Info("marking ami for deletion",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("scheduled-deletion", date),
+		)
+	}
+	_, err := a.EC2Client.CreateTags(&ec2.CreateTagsInput{
+		DryRun:    aws.Bool(!a.Delete),
+		Resources: []*string{image.ImageId},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(ScheduledDeletionTag), Value: aws.String(date)},
+			{Key: aws.String(MarkedTag), Value: aws.String(today)},
+		},
+	})
+	if (err == nil || isDryRun(err)) && a.MarkPrivate {
+		err = a.makePrivate(image)
+	}
+	if err != nil && !isDryRun(err) {
+		result.Status = PurgeStatusFailed
+		result.Error = err.Error()
+		result.add(ResourceTypeImage, *image.ImageId, result.Status, err)
+		return result, err
+	}
+
+	if a.Delete {
+		result.Status = PurgeStatusMarked
+	} else {
+		a.Logger.Info("would mark ami for deletion",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("scheduled-deletion", date),
+		)
+		result.Status = PurgeStatusWouldMark
+	}
+	result.add(ResourceTypeImage, *image.ImageId, result.Status, nil)
+	return result, nil
+}
+
+// makePrivate removes every launch permission an image has, so that
+// neither the public nor any account, organization or organizational
+// unit it was shared with can launch it any more.
+func (a *AMIClean) makePrivate(image *ec2.Image) error {
+	output, err := a.EC2Client.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
+		Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+		ImageId:   image.ImageId,
+	})
+	if err != nil {
+		return err
+	}
+	permissions := output.LaunchPermissions
+	// DescribeImages already tells us if the image is public, so we
+	// make sure not to miss that.
+	if aws.BoolValue(image.Public) && !hasGroupAll(permissions) {
+		permissions = append(permissions, &ec2.LaunchPermission{Group: aws.String(ec2.PermissionGroupAll)})
+	}
+	if len(permissions) == 0 {
+		return nil
+	}
+
+	a.Logger.Info("removing launch permissions from ami",
+		zap.String("ami-id", *image.ImageId),
+		zap.Strings("shared-with", launchPermissionGrantees(permissions)),
+	)
+	_, err = a.EC2Client.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+		DryRun:  aws.Bool(!a.Delete),
+		ImageId: image.ImageId,
+		LaunchPermission: &ec2.LaunchPermissionModifications{
+			Remove: permissions,
+		},
+	})
+	return err
+}
+
+// hasGroupAll reports whether launch permissions make an image public.
+func hasGroupAll(permissions []*ec2.LaunchPermission) bool {
+	for _, permission := range permissions {
+		if aws.StringValue(permission.Group) == ec2.PermissionGroupAll {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarkImage removes our marks from an image that no longer matches the
+// purge criteria, so that if it matches again later it gets a fresh grace
+// period rather than being deleted straight away.
+func (a *AMIClean) UnmarkImage(image *ec2.Image) error {
+	if a.Delete {
+		a.Logger.Info("unmarking ami no longer scheduled for deletion",
+			zap.String("ami-id", *image.ImageId),
+		)
+	} else {
+		a.Logger.Info("would unmark ami no longer scheduled for deletion",
+			zap.String("ami-id", *image.ImageId),
+		)
+	}
+	_, err := a.EC2Client.DeleteTags(&ec2.DeleteTagsInput{
+		DryRun:    aws.Bool(!a.Delete),
+		Resources: []*string{image.ImageId},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(ScheduledDeletionTag)},
+			{Key: aws.String(MarkedTag)},
+		},
+	})
+	if err != nil && !isDryRun(err) {
+		return err
+	}
+	return nil
+}
+
+// now returns Now if it's set, or the current time.
+func (a *AMIClean) now() time.Time {
+	if a.Now.IsZero() {
+		return time.Now().UTC()
+	}
+	return a.Now
+}
@@ -0,0 +1,66 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// SnapshotIndex maps each snapshot ID to the IDs of the images that use
+// it. Copying or re-registering an AMI can leave several images sharing a
+// snapshot, and deleting it out from under the ones we're keeping would
+// break them (if AWS let us, which it usually doesn't).
+type SnapshotIndex map[string][]string
+
+// BuildSnapshotIndex pages through every image we own, ignoring our
+// selection criteria, and records which snapshots each one uses.
+func (a *AMIClean) BuildSnapshotIndex() (SnapshotIndex, error) {
+	index := SnapshotIndex{}
+	err := a.describeImages(nil, func(image *ec2.Image) bool {
+		index.addImage(image)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.Logger.Info("built snapshot index",
+		zap.Int("snapshot-count", len(index)),
+	)
+	return index, nil
+}
+
+// imageSnapshots returns the IDs of the EBS snapshots an image uses.
+func imageSnapshots(image *ec2.Image) []string {
+	var snapshotIDs []string
+	for _, blockDevice := range image.BlockDeviceMappings {
+		if blockDevice.Ebs != nil && blockDevice.Ebs.SnapshotId != nil {
+			snapshotIDs = append(snapshotIDs, *blockDevice.Ebs.SnapshotId)
+		}
+	}
+	return snapshotIDs
+}
+
+func (s SnapshotIndex) addImage(image *ec2.Image) {
+	for _, snapshotID := range imageSnapshots(image) {
+		s[snapshotID] = append(s[snapshotID], aws.StringValue(image.ImageId))
+	}
+}
+
+// removeImage drops an image we've deregistered from the index, so that
+// its snapshots can be deleted once no other image uses them.
+func (s SnapshotIndex) removeImage(image *ec2.Image) {
+	for _, snapshotID := range imageSnapshots(image) {
+		var remaining []string
+		for _, imageID := range s[snapshotID] {
+			if imageID != aws.StringValue(image.ImageId) {
+				remaining = append(remaining, imageID)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(s, snapshotID)
+		} else {
+			s[snapshotID] = remaining
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+
+	"fmt"
+	"strings"
+)
+
+// UsageIndex maps the ID of every AMI something in the account could
+// launch from to a description of the first thing we found using it.
+// Launch configurations and launch templates can't be filtered by AMI ID
+// the way instances can, so rather than asking AWS about each image we
+// fetch all of them once up front and look images up in here.
+type UsageIndex map[string]string
+
+// BuildUsageIndex collects every AMI ID referenced by an instance that
+// isn't terminated (stopped instances can be started again), by any
+// version of a launch template, or by a launch configuration. Auto
+// Scaling groups always launch from one of the latter two, so this covers
+// them as well.
+func (a *AMIClean) BuildUsageIndex() (UsageIndex, error) {
+	index := UsageIndex{}
+
+	instancesInput := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name: aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{
+				"pending", "running", "shutting-down", "stopping", "stopped",
+			}),
+		}},
+	}
+	err := a.EC2Client.DescribeInstancesPages(instancesInput,
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			index.addReservations(page.Reservations)
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var templateIDs []*string
+	err = a.EC2Client.DescribeLaunchTemplatesPages(&ec2.DescribeLaunchTemplatesInput{},
+		func(page *ec2.DescribeLaunchTemplatesOutput, lastPage bool) bool {
+			for _, template := range page.LaunchTemplates {
+				templateIDs = append(templateIDs, template.LaunchTemplateId)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Launch templates can only have all their versions described one
+	// template at a time.
+	for _, templateID := range templateIDs {
+		versionsInput := &ec2.DescribeLaunchTemplateVersionsInput{
+			LaunchTemplateId: templateID,
+			// This resolves "resolve:ssm:" parameters into the
+			// AMI ID they currently point at.
+			ResolveAlias: aws.Bool(true),
+		}
+		err = a.EC2Client.DescribeLaunchTemplateVersionsPages(versionsInput,
+			func(page *ec2.DescribeLaunchTemplateVersionsOutput, lastPage bool) bool {
+				index.addLaunchTemplateVersions(page.LaunchTemplateVersions)
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = a.AutoScalingClient.DescribeLaunchConfigurationsPages(&autoscaling.DescribeLaunchConfigurationsInput{},
+		func(page *autoscaling.DescribeLaunchConfigurationsOutput, lastPage bool) bool {
+			index.addLaunchConfigurations(page.LaunchConfigurations)
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	a.Logger.Info("built ami usage index",
+		zap.Int("ami-count", len(index)),
+	)
+
+	return index, nil
+}
+
+// add records that user is using the AMI, keeping the first user we saw.
+func (u UsageIndex) add(imageID *string, user string) {
+	// Launch templates don't have to specify an AMI at all, and ones
+	// that use an SSM parameter we couldn't resolve won't have an AMI ID.
+	if imageID == nil || !strings.HasPrefix(*imageID, "ami-") {
+		return
+	}
+	if _, ok := u[*imageID]; !ok {
+		u[*imageID] = user
+	}
+}
+
+func (u UsageIndex) addReservations(reservations []*ec2.Reservation) {
+	for _, reservation := range reservations {
+		for _, instance := range reservation.Instances {
+			u.add(instance.ImageId, fmt.Sprintf("instance %s",
+				aws.StringValue(instance.InstanceId)))
+		}
+	}
+}
+
+func (u UsageIndex) addLaunchTemplateVersions(versions []*ec2.LaunchTemplateVersion) {
+	for _, version := range versions {
+		if version.LaunchTemplateData == nil {
+			continue
+		}
+		u.add(version.LaunchTemplateData.ImageId, fmt.Sprintf("launch template %s version %d",
+			aws.StringValue(version.LaunchTemplateId),
+			aws.Int64Value(version.VersionNumber)))
+	}
+}
+
+func (u UsageIndex) addLaunchConfigurations(configurations []*autoscaling.LaunchConfiguration) {
+	for _, configuration := range configurations {
+		u.add(configuration.ImageId, fmt.Sprintf("launch configuration %s",
+			aws.StringValue(configuration.LaunchConfigurationName)))
+	}
+}
@@ -0,0 +1,479 @@
+package packerjanitor
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// createImageDescription picks the builder instance out of the
+// description EC2 gives the snapshots it takes for CreateImage, which
+// looks like "Created by CreateImage(i-0123456789abcdef0) for ami-...".
+var createImageDescription = regexp.MustCompile(`CreateImage\((i-[0-9a-f]+)\)`)
+
+// Leftovers are the billable resources an aborted build can leave behind
+// once its instance is gone.
+type Leftovers struct {
+	Volumes           []*ec2.Volume
+	Snapshots         []*ec2.Snapshot
+	NetworkInterfaces []*ec2.NetworkInterface
+}
+
+// BuilderTag is the tag we put on the volumes a builder will leave
+// behind when it's terminated, which are the ones with
+// delete_on_termination set to false, to record which builder they came
+// from. Its value is the builder's instance ID.
+const BuilderTag = "packer-janitor:builder"
+
+// builderVolumeIDs returns the IDs of the volumes attached to an instance
+// that won't be deleted along with it.
+func builderVolumeIDs(instance *ec2.Instance) []*string {
+	var ids []*string
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil && !aws.BoolValue(mapping.Ebs.DeleteOnTermination) {
+			ids = append(ids, mapping.Ebs.VolumeId)
+		}
+	}
+	return ids
+}
+
+// MarkBuilderVolumes tags the volumes each builder will leave behind with
+// the BuilderTag, so that once the builder is gone we know they're ours
+// to delete. We carry on past failures and return the last error.
+func (p *PackerClean) MarkBuilderVolumes(instances []*ec2.Instance) error {
+	var err error
+	for _, instance := range instances {
+		ids := builderVolumeIDs(instance)
+		if len(ids) == 0 {
+			continue
+		}
+		_, tagErr := p.EC2Client.CreateTags(&ec2.CreateTagsInput{
+			DryRun:    aws.Bool(!p.Delete),
+			Resources: ids,
+			Tags: []*ec2.Tag{
+				{Key: aws.String(BuilderTag), Value: instance.InstanceId},
+			},
+		})
+		if tagErr != nil && !isDryRun(tagErr) {
+			p.Logger.Error("Error while attempting to mark builder volumes",
+				zap.String("instance-id", aws.StringValue(instance.InstanceId)),
+				zap.Strings("volume-ids", aws.StringValueSlice(ids)),
+				zap.Error(tagErr),
+			)
+			err = tagErr
+		}
+	}
+	return err
+}
+
+// liveInstanceIDs returns the IDs of every instance that hasn't been
+// terminated.
+func (p *PackerClean) liveInstanceIDs() (map[string]bool, error) {
+	live := map[string]bool{}
+	instances, err := p.liveInstances()
+	for _, instance := range instances {
+		live[aws.StringValue(instance.InstanceId)] = true
+	}
+	return live, err
+}
+
+// liveBuilders returns the instances that match our rules for builders
+// and haven't been terminated, leaving out the ones with the KeepTag.
+func (p *PackerClean) liveBuilders() ([]*ec2.Instance, error) {
+	rules := p.rules()
+	instances, err := p.liveInstances()
+	if err != nil {
+		return nil, err
+	}
+	var builders []*ec2.Instance
+	for _, instance := range instances {
+		if rules.Match(instance) && !hasTag(instance, KeepTag) {
+			builders = append(builders, instance)
+		}
+	}
+	return builders, nil
+}
+
+// GetLeftoverVolumes finds detached volumes created before the
+// expiration date that are tagged like our builders, or that we marked
+// with the BuilderTag, and whose builder no longer exists. That's what's
+// left when a template sets delete_on_termination to false. The
+// BuilderTag tells us which builder a volume came from, so we leave
+// alone the ones whose builder is still around; a volume we never marked
+// is one whose builder we never saw, usually because it died between
+// runs.
+func (p *PackerClean) GetLeftoverVolumes() ([]*ec2.Volume, error) {
+	rules := p.rules()
+
+	live, err := p.liveInstanceIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("status"),
+			Values: []*string{aws.String(ec2.VolumeStateAvailable)},
+		}},
+	}
+
+	var volumes []*ec2.Volume
+	err = p.EC2Client.DescribeVolumesPages(input,
+		func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			for _, volume := range page.Volumes {
+				builder, marked := tagValue(volume.Tags, BuilderTag)
+				if marked && live[builder] {
+					continue
+				}
+				if !marked && !rules.MatchTags(volume.Tags) {
+					continue
+				}
+				if volume.CreateTime == nil || !volume.CreateTime.Before(p.ExpirationDate) {
+					continue
+				}
+				volumes = append(volumes, volume)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// tagValue looks up a tag by key.
+func tagValue(tags []*ec2.Tag, key string) (string, bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
+
+// imageSnapshots returns the IDs of the snapshots our own images use,
+// including images that are still being created.
+func (p *PackerClean) imageSnapshots() (map[string]bool, error) {
+	snapshots := map[string]bool{}
+	input := &ec2.DescribeImagesInput{
+		Owners: []*string{aws.String("self")},
+	}
+	err := p.EC2Client.DescribeImagesPages(input,
+		func(page *ec2.DescribeImagesOutput, lastPage bool) bool {
+			for _, image := range page.Images {
+				for _, mapping := range image.BlockDeviceMappings {
+					if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+						snapshots[*mapping.Ebs.SnapshotId] = true
+					}
+				}
+			}
+			return true
+		})
+	return snapshots, err
+}
+
+// maxFilterValues is the most values we put in one filter.
+const maxFilterValues = 200
+
+// knownBuilders returns which of the given instances match our rules for
+// builders, as far as EC2 can still tell us. It remembers terminated
+// instances for about an hour, so this covers builders we terminated
+// ourselves, as well as ones that are still around.
+func (p *PackerClean) knownBuilders(ids []string) (map[string]bool, error) {
+	rules := p.rules()
+	builders := map[string]bool{}
+	for start := 0; start < len(ids); start += maxFilterValues {
+		end := start + maxFilterValues
+		if end > len(ids) {
+			end = len(ids)
+		}
+		// We filter on the instance IDs rather than asking for
+		// them, since asking for an instance EC2 has forgotten
+		// about is an error.
+		input := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("instance-id"),
+				Values: aws.StringSlice(ids[start:end]),
+			}},
+		}
+		err := p.EC2Client.DescribeInstancesPages(input,
+			func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+				for _, reservation := range page.Reservations {
+					for _, instance := range reservation.Instances {
+						if rules.Match(instance) {
+							builders[aws.StringValue(instance.InstanceId)] = true
+						}
+					}
+				}
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builders, nil
+}
+
+// markedVolumeIDs returns the IDs of the volumes we've marked with the
+// BuilderTag, whatever state they're in.
+func (p *PackerClean) markedVolumeIDs() (map[string]bool, error) {
+	marked := map[string]bool{}
+	input := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String(BuilderTag)},
+		}},
+	}
+	err := p.EC2Client.DescribeVolumesPages(input,
+		func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			for _, volume := range page.Volumes {
+				if _, ok := tagValue(volume.Tags, BuilderTag); ok {
+					marked[aws.StringValue(volume.VolumeId)] = true
+				}
+			}
+			return true
+		})
+	return marked, err
+}
+
+// GetLeftoverSnapshots finds snapshots started before the expiration date
+// that CreateImage took from a builder that no longer exists, and that
+// aren't part of any of our images. These are what's left when a build
+// is aborted while it's creating an image. The snapshots usually don't
+// have any of the builder's tags, so we go by the builder instead: either
+// EC2 still remembers it as one of ours, or the snapshot was taken from a
+// volume we marked with the BuilderTag. Anything else, like a snapshot
+// someone took by hand, a copy, or an image taken from some other
+// instance, isn't ours to delete.
+func (p *PackerClean) GetLeftoverSnapshots() ([]*ec2.Snapshot, error) {
+	inImages, err := p.imageSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	live, err := p.liveInstanceIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+	}
+	var candidates []*ec2.Snapshot
+	var builderIDs []string
+	seen := map[string]bool{}
+	err = p.EC2Client.DescribeSnapshotsPages(input,
+		func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+			for _, snapshot := range page.Snapshots {
+				if inImages[aws.StringValue(snapshot.SnapshotId)] {
+					continue
+				}
+				if snapshot.StartTime == nil || !snapshot.StartTime.Before(p.ExpirationDate) {
+					continue
+				}
+				builder := snapshotBuilder(snapshot)
+				if builder == "" || live[builder] {
+					continue
+				}
+				candidates = append(candidates, snapshot)
+				if !seen[builder] {
+					seen[builder] = true
+					builderIDs = append(builderIDs, builder)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	builders, err := p.knownBuilders(builderIDs)
+	if err != nil {
+		return nil, err
+	}
+	marked, err := p.markedVolumeIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*ec2.Snapshot
+	for _, snapshot := range candidates {
+		if builders[snapshotBuilder(snapshot)] || marked[aws.StringValue(snapshot.VolumeId)] {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// snapshotBuilder returns the ID of the instance CreateImage took a
+// snapshot from, or an empty string if it wasn't taken by CreateImage.
+func snapshotBuilder(snapshot *ec2.Snapshot) string {
+	match := createImageDescription.FindStringSubmatch(aws.StringValue(snapshot.Description))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// GetLeftoverNetworkInterfaces finds network interfaces that aren't
+// attached to anything but are in one of Packer's security groups.
+// They'd stop us from deleting the security group, and there's no
+// instance left to take them with it. EC2 doesn't tell us how old a
+// network interface is, so we leave alone any that share a security
+// group with an instance that hasn't been terminated, which covers a
+// build that's still launching.
+func (p *PackerClean) GetLeftoverNetworkInterfaces() ([]*ec2.NetworkInterface, error) {
+	rules := p.orphanRules()
+
+	instances, err := p.liveInstances()
+	if err != nil {
+		return nil, err
+	}
+	inUse := map[string]bool{}
+	for _, instance := range instances {
+		for _, group := range instance.SecurityGroups {
+			inUse[aws.StringValue(group.GroupId)] = true
+		}
+	}
+
+	input := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("status"),
+			Values: []*string{aws.String(ec2.NetworkInterfaceStatusAvailable)},
+		}},
+	}
+
+	var networkInterfaces []*ec2.NetworkInterface
+	err = p.EC2Client.DescribeNetworkInterfacesPages(input,
+		func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
+			for _, networkInterface := range page.NetworkInterfaces {
+				if leftoverNetworkInterface(networkInterface, rules, inUse) {
+					networkInterfaces = append(networkInterfaces, networkInterface)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return networkInterfaces, nil
+}
+
+// leftoverNetworkInterface reports whether a network interface is in one
+// of Packer's security groups, and in none that a live instance is using.
+func leftoverNetworkInterface(networkInterface *ec2.NetworkInterface, rules MatchRules, inUse map[string]bool) bool {
+	packer := false
+	for _, group := range networkInterface.Groups {
+		if inUse[aws.StringValue(group.GroupId)] {
+			return false
+		}
+		if rules.MatchSecurityGroupName(aws.StringValue(group.GroupName)) {
+			packer = true
+		}
+	}
+	return packer
+}
+
+// GetLeftovers finds all the volumes, snapshots and network interfaces
+// aborted builds have left behind.
+func (p *PackerClean) GetLeftovers() (*Leftovers, error) {
+	var leftovers Leftovers
+	var err error
+
+	leftovers.Volumes, err = p.GetLeftoverVolumes()
+	if err != nil {
+		return nil, err
+	}
+	leftovers.Snapshots, err = p.GetLeftoverSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	leftovers.NetworkInterfaces, err = p.GetLeftoverNetworkInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return &leftovers, nil
+}
+
+// SweepLeftovers deletes the volumes, snapshots and network interfaces
+// aborted builds have left behind, after marking the volumes the builders
+// that are still around will leave behind. Like SweepOrphans, we carry
+// on past failures and return an error at the end if there were any, and
+// stop if ctx is done.
+func (p *PackerClean) SweepLeftovers(ctx context.Context) error {
+	failures := 0
+
+	builders, err := p.liveBuilders()
+	if err == nil {
+		err = p.MarkBuilderVolumes(builders)
+	}
+	if err != nil {
+		p.Logger.Error("Error while attempting to mark Packer builder volumes",
+			zap.Error(err),
+		)
+		failures++
+	}
+
+	leftovers, err := p.GetLeftovers()
+	if err != nil {
+		p.Logger.Error("Error while attempting to find leftover Packer resources",
+			zap.Error(err),
+		)
+		return err
+	}
+
+	done := 0
+	for _, volume := range leftovers.Volumes {
+		if ctx.Err() != nil {
+			break
+		}
+		done++
+		_, err := p.EC2Client.DeleteVolume(&ec2.DeleteVolumeInput{
+			DryRun:   aws.Bool(!p.Delete),
+			VolumeId: volume.VolumeId,
+		})
+		if p.deleteResource("volume", "volume-id", *volume.VolumeId, err) != nil {
+			failures++
+		}
+	}
+	for _, snapshot := range leftovers.Snapshots {
+		if ctx.Err() != nil {
+			break
+		}
+		done++
+		_, err := p.EC2Client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+			DryRun:     aws.Bool(!p.Delete),
+			SnapshotId: snapshot.SnapshotId,
+		})
+		if p.deleteResource("snapshot", "snapshot-id", *snapshot.SnapshotId, err) != nil {
+			failures++
+		}
+	}
+	for _, networkInterface := range leftovers.NetworkInterfaces {
+		if ctx.Err() != nil {
+			break
+		}
+		done++
+		_, err := p.EC2Client.DeleteNetworkInterface(&ec2.DeleteNetworkInterfaceInput{
+			DryRun:             aws.Bool(!p.Delete),
+			NetworkInterfaceId: networkInterface.NetworkInterfaceId,
+		})
+		if p.deleteResource("network interface", "network-interface-id", *networkInterface.NetworkInterfaceId, err) != nil {
+			failures++
+		}
+	}
+
+	if total := len(leftovers.Volumes) + len(leftovers.Snapshots) + len(leftovers.NetworkInterfaces); done < total {
+		return fmt.Errorf("ran out of time with %d of %d leftover Packer resources left to delete: %v", total-done, total, ctx.Err())
+	}
+	if failures > 0 {
+		return fmt.Errorf("unable to delete %d leftover Packer resources", failures)
+	}
+	return nil
+}
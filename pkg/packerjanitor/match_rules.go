@@ -0,0 +1,151 @@
+package packerjanitor
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MatchRules decide which instances are builders we should clean up
+// after. An instance is a builder if it matches any one of the rules.
+type MatchRules struct {
+	// Tags match instances with a tag set to the given value, or
+	// with the tag set at all if the value is empty.
+	Tags []*ec2.Tag
+	// KeyNamePrefixes match instances launched with a key pair whose
+	// name starts with one of them, like "packer_".
+	KeyNamePrefixes []string
+	// SecurityGroupPatterns match instances in a security group whose
+	// name matches one of them, using path.Match, like "packer_*".
+	SecurityGroupPatterns []string
+}
+
+// DefaultMatchRules match the Name tag Packer gives its instances when
+// the template doesn't set one.
+var DefaultMatchRules = MatchRules{
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+	},
+}
+
+// ParseTagRule turns "Key=Value" or "Key" into a tag for MatchRules.
+func ParseTagRule(rule string) (*ec2.Tag, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("tag rule %q has no key", rule)
+	}
+	tag := &ec2.Tag{Key: aws.String(parts[0]), Value: aws.String("")}
+	if len(parts) == 2 {
+		tag.Value = aws.String(parts[1])
+	}
+	return tag, nil
+}
+
+// IsEmpty reports whether there are no rules at all.
+func (r MatchRules) IsEmpty() bool {
+	return len(r.Tags) == 0 && len(r.KeyNamePrefixes) == 0 && len(r.SecurityGroupPatterns) == 0
+}
+
+// Match reports whether an instance matches any of the rules.
+func (r MatchRules) Match(instance *ec2.Instance) bool {
+	if r.MatchTags(instance.Tags) {
+		return true
+	}
+
+	if r.matchKeyName(aws.StringValue(instance.KeyName)) {
+		return true
+	}
+
+	for _, group := range instance.SecurityGroups {
+		if r.MatchSecurityGroupName(aws.StringValue(group.GroupName)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchTags reports whether a set of tags matches any of the tag rules.
+// We also use this to find the volumes builders leave behind, since
+// Packer templates usually tag them the same way.
+func (r MatchRules) MatchTags(tags []*ec2.Tag) bool {
+	for _, rule := range r.Tags {
+		for _, tag := range tags {
+			if aws.StringValue(tag.Key) != aws.StringValue(rule.Key) {
+				continue
+			}
+			if aws.StringValue(rule.Value) == "" || aws.StringValue(tag.Value) == aws.StringValue(rule.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchKeyName reports whether a key pair name starts with any of the key
+// name prefixes.
+func (r MatchRules) matchKeyName(name string) bool {
+	for _, prefix := range r.KeyNamePrefixes {
+		if name != "" && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchSecurityGroupName reports whether a security group name matches
+// any of the security group patterns.
+func (r MatchRules) MatchSecurityGroupName(name string) bool {
+	for _, pattern := range r.SecurityGroupPatterns {
+		// The patterns are checked when they're parsed, so we can
+		// ignore the error here.
+		if matched, _ := path.Match(pattern, name); matched && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the security group patterns are well formed.
+func (r MatchRules) Validate() error {
+	for _, pattern := range r.SecurityGroupPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("security group pattern %q is malformed: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// filterEscaper escapes the characters EC2 filters treat as wildcards.
+var filterEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+
+// filters returns the DescribeInstances filters we can use to narrow
+// down the search server-side. EC2 ANDs filters together, so we can only
+// do this when all the rules are of one kind; otherwise we rely on Match
+// alone.
+func (r MatchRules) filters() []*ec2.Filter {
+	switch {
+	case len(r.Tags) > 0 && len(r.KeyNamePrefixes) == 0 && len(r.SecurityGroupPatterns) == 0:
+		key := aws.StringValue(r.Tags[0].Key)
+		var values []*string
+		for _, tag := range r.Tags {
+			// Different keys, or any value at all for a key, mean
+			// we can't express this as one tag filter.
+			if aws.StringValue(tag.Key) != key || aws.StringValue(tag.Value) == "" {
+				return nil
+			}
+			values = append(values, aws.String(filterEscaper.Replace(*tag.Value)))
+		}
+		return []*ec2.Filter{{Name: aws.String("tag:" + key), Values: values}}
+	case len(r.Tags) == 0 && len(r.KeyNamePrefixes) > 0 && len(r.SecurityGroupPatterns) == 0:
+		var values []*string
+		for _, prefix := range r.KeyNamePrefixes {
+			values = append(values, aws.String(filterEscaper.Replace(prefix)+"*"))
+		}
+		return []*ec2.Filter{{Name: aws.String("key-name"), Values: values}}
+	}
+	return nil
+}
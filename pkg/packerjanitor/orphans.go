@@ -0,0 +1,296 @@
+package packerjanitor
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultKeyNamePrefix is the prefix Packer gives the key pairs it
+	// creates.
+	DefaultKeyNamePrefix = "packer_"
+	// DefaultSecurityGroupPattern matches the names Packer gives the
+	// security groups it creates.
+	DefaultSecurityGroupPattern = "packer_*"
+	// OrphanedSinceTag is the tag we put on orphaned security groups
+	// to record when we first found them, since EC2 doesn't tell us
+	// when a security group was created. Its value is an RFC 3339
+	// time.
+	OrphanedSinceTag = "packer-janitor:orphaned-since"
+)
+
+// liveInstanceStates are all the states an instance can be in while it
+// still holds on to its key pair and security groups.
+var liveInstanceStates = []string{
+	ec2.InstanceStateNamePending,
+	ec2.InstanceStateNameRunning,
+	ec2.InstanceStateNameShuttingDown,
+	ec2.InstanceStateNameStopping,
+	ec2.InstanceStateNameStopped,
+}
+
+// orphanRules returns the rules for recognizing key pairs and security
+// groups Packer created: the ones in Rules, or Packer's defaults if
+// there aren't any of that kind.
+func (p *PackerClean) orphanRules() MatchRules {
+	rules := MatchRules{
+		KeyNamePrefixes:       p.Rules.KeyNamePrefixes,
+		SecurityGroupPatterns: p.Rules.SecurityGroupPatterns,
+	}
+	if len(rules.KeyNamePrefixes) == 0 {
+		rules.KeyNamePrefixes = []string{DefaultKeyNamePrefix}
+	}
+	if len(rules.SecurityGroupPatterns) == 0 {
+		rules.SecurityGroupPatterns = []string{DefaultSecurityGroupPattern}
+	}
+	return rules
+}
+
+// liveInstances returns every instance that hasn't been terminated.
+func (p *PackerClean) liveInstances() ([]*ec2.Instance, error) {
+	var instances []*ec2.Instance
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(liveInstanceStates),
+		}},
+	}
+	err := p.EC2Client.DescribeInstancesPages(input,
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range page.Reservations {
+				instances = append(instances, reservation.Instances...)
+			}
+			return true
+		})
+	return instances, err
+}
+
+// keyNamesInUse returns the names of the key pairs that instances which
+// haven't been terminated were launched with.
+func (p *PackerClean) keyNamesInUse() (map[string]bool, error) {
+	inUse := map[string]bool{}
+	instances, err := p.liveInstances()
+	for _, instance := range instances {
+		if instance.KeyName != nil {
+			inUse[*instance.KeyName] = true
+		}
+	}
+	return inUse, err
+}
+
+// securityGroupsInUse returns the IDs of the security groups that are
+// attached to a network interface, which covers instances as well as
+// everything else that can use a security group.
+func (p *PackerClean) securityGroupsInUse() (map[string]bool, error) {
+	inUse := map[string]bool{}
+	err := p.EC2Client.DescribeNetworkInterfacesPages(&ec2.DescribeNetworkInterfacesInput{},
+		func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
+			for _, networkInterface := range page.NetworkInterfaces {
+				for _, group := range networkInterface.Groups {
+					inUse[aws.StringValue(group.GroupId)] = true
+				}
+			}
+			return true
+		})
+	return inUse, err
+}
+
+// GetOrphanedKeyPairs finds key pairs Packer created before the
+// expiration date that no instance is using.
+func (p *PackerClean) GetOrphanedKeyPairs() ([]*ec2.KeyPairInfo, error) {
+	rules := p.orphanRules()
+
+	output, err := p.EC2Client.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{})
+	if err != nil {
+		return nil, err
+	}
+	inUse, err := p.keyNamesInUse()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []*ec2.KeyPairInfo
+	for _, keyPair := range output.KeyPairs {
+		name := aws.StringValue(keyPair.KeyName)
+		if !rules.matchKeyName(name) || inUse[name] {
+			continue
+		}
+		// Key pairs created before EC2 started recording when they
+		// were created are certainly old enough.
+		if keyPair.CreateTime != nil && !keyPair.CreateTime.Before(p.ExpirationDate) {
+			continue
+		}
+		orphans = append(orphans, keyPair)
+	}
+
+	return orphans, nil
+}
+
+// orphanedSince returns when we first found a security group orphaned,
+// if we've marked it.
+func orphanedSince(group *ec2.SecurityGroup) (time.Time, bool) {
+	for _, tag := range group.Tags {
+		if aws.StringValue(tag.Key) == OrphanedSinceTag {
+			since, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value))
+			return since, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// GetOrphanedSecurityGroups finds security groups Packer created that
+// have had no network interfaces attached since before the expiration
+// date. The first time we find a group orphaned we mark it with the
+// OrphanedSinceTag, and if a marked group turns out to be in use again
+// we remove the mark, so a group is only deleted by a run at least the
+// time limit after the one that first found it. A dry run never marks
+// anything, so it would never get that far; it goes by the network
+// interfaces alone, and reports every group a real run would mark or
+// delete.
+func (p *PackerClean) GetOrphanedSecurityGroups() ([]*ec2.SecurityGroup, error) {
+	rules := p.orphanRules()
+
+	inUse, err := p.securityGroupsInUse()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans, mark, unmark []*ec2.SecurityGroup
+	err = p.EC2Client.DescribeSecurityGroupsPages(&ec2.DescribeSecurityGroupsInput{},
+		func(page *ec2.DescribeSecurityGroupsOutput, lastPage bool) bool {
+			for _, group := range page.SecurityGroups {
+				if !rules.MatchSecurityGroupName(aws.StringValue(group.GroupName)) {
+					continue
+				}
+				since, marked := orphanedSince(group)
+				if inUse[aws.StringValue(group.GroupId)] {
+					if marked {
+						unmark = append(unmark, group)
+					}
+					continue
+				}
+				if !marked {
+					mark = append(mark, group)
+				}
+				if !p.Delete || (marked && since.Before(p.ExpirationDate)) {
+					orphans = append(orphans, group)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	markMessage, unmarkMessage := "Marking orphaned security group", "Unmarking security group that is in use again"
+	if !p.Delete {
+		markMessage, unmarkMessage = "Would have marked orphaned security group", "Would have unmarked security group that is in use again"
+	}
+
+	now := p.now().Format(time.RFC3339)
+	for _, group := range mark {
+		p.Logger.Info(markMessage,
+			zap.String("security-group", *group.GroupId),
+			zap.String("orphaned-since", now),
+		)
+		_, err := p.EC2Client.CreateTags(&ec2.CreateTagsInput{
+			DryRun:    aws.Bool(!p.Delete),
+			Resources: []*string{group.GroupId},
+			Tags:      []*ec2.Tag{{Key: aws.String(OrphanedSinceTag), Value: aws.String(now)}},
+		})
+		if err != nil && !isDryRun(err) {
+			return nil, err
+		}
+	}
+	for _, group := range unmark {
+		p.Logger.Info(unmarkMessage,
+			zap.String("security-group", *group.GroupId),
+		)
+		_, err := p.EC2Client.DeleteTags(&ec2.DeleteTagsInput{
+			DryRun:    aws.Bool(!p.Delete),
+			Resources: []*string{group.GroupId},
+			Tags:      []*ec2.Tag{{Key: aws.String(OrphanedSinceTag)}},
+		})
+		if err != nil && !isDryRun(err) {
+			return nil, err
+		}
+	}
+
+	return orphans, nil
+}
+
+// DeleteKeyPair deletes a key pair, or checks that we could if we're in
+// a dry run.
+func (p *PackerClean) DeleteKeyPair(keyName *string) error {
+	_, err := p.EC2Client.DeleteKeyPair(&ec2.DeleteKeyPairInput{
+		DryRun:  aws.Bool(!p.Delete),
+		KeyName: keyName,
+	})
+	return p.deleteResource("keypair", "keypair", *keyName, err)
+}
+
+// DeleteSecurityGroup deletes a security group, or checks that we could
+// if we're in a dry run.
+func (p *PackerClean) DeleteSecurityGroup(groupID *string) error {
+	_, err := p.EC2Client.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
+		DryRun:  aws.Bool(!p.Delete),
+		GroupId: groupID,
+	})
+	return p.deleteResource("security group", "security-group", *groupID, err)
+}
+
+// SweepOrphans deletes the key pairs and security groups Packer left
+// behind without an instance, which happens when Packer itself dies
+// partway through a build. We carry on past failures to delete any one
+// of them, and return an error at the end if there were any. If ctx is
+// done before we've finished, we stop and return an error saying how
+// many we didn't get to.
+func (p *PackerClean) SweepOrphans(ctx context.Context) error {
+	keyPairs, err := p.GetOrphanedKeyPairs()
+	if err != nil {
+		p.Logger.Error("Error while attempting to find orphaned keypairs",
+			zap.Error(err),
+		)
+		return err
+	}
+	groups, err := p.GetOrphanedSecurityGroups()
+	if err != nil {
+		p.Logger.Error("Error while attempting to find orphaned security groups",
+			zap.Error(err),
+		)
+		return err
+	}
+
+	failures, done := 0, 0
+	for _, keyPair := range keyPairs {
+		if ctx.Err() != nil {
+			break
+		}
+		done++
+		if p.DeleteKeyPair(keyPair.KeyName) != nil {
+			failures++
+		}
+	}
+	for _, group := range groups {
+		if ctx.Err() != nil {
+			break
+		}
+		done++
+		if p.DeleteSecurityGroup(group.GroupId) != nil {
+			failures++
+		}
+	}
+
+	if total := len(keyPairs) + len(groups); done < total {
+		return fmt.Errorf("ran out of time with %d of %d orphaned Packer resources left to delete: %v", total-done, total, ctx.Err())
+	}
+	if failures > 0 {
+		return fmt.Errorf("unable to delete %d orphaned Packer resources", failures)
+	}
+	return nil
+}
@@ -7,6 +7,9 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"go.uber.org/zap"
 
+	"context"
+	"fmt"
+	"sync"
 	"time"
 )
 
@@ -25,217 +28,567 @@ type PackerClean struct {
 	ExpirationDate time.Time
 	Logger         *zap.Logger
 	EC2Client      ec2iface.EC2API
+	// Rules decide which instances are builders; if they're empty,
+	// DefaultMatchRules are used.
+	Rules MatchRules
+	// Now is when we're running; if it's not set, we use the current
+	// time.
+	Now time.Time
+	// Workers is how many instances PurgePackerResources waits on at
+	// once.
+	Workers int
+	// WarningDate is when instances that haven't reached the
+	// ExpirationDate yet become overdue; if it's not set, there's no
+	// warning stage.
+	WarningDate time.Time
+	// UnwarnedDate is when instances we've never managed to mark as
+	// warned about are abandoned anyway, so that warnings that keep
+	// failing can't keep an instance around for good; if it's not set,
+	// they're kept until we have.
+	UnwarnedDate time.Time
 }
 
-// GetPackerInstances -- find all running instances that are Packer
-// builds older than X and returns them in a list
-func (p *PackerClean) GetPackerInstances() ([]*ec2.Instance, error) {
-	// Instances Packer starts all have the Name tag "Packer Builder".
-	packerFilter := &ec2.Filter{
-		Name:   aws.String("tag:Name"),
-		Values: []*string{aws.String("Packer Builder")},
+// now returns Now if it's set, or the current time.
+func (p *PackerClean) now() time.Time {
+	if p.Now.IsZero() {
+		return time.Now().UTC()
 	}
-	input := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{packerFilter},
+	return p.Now
+}
+
+// isDryRun reports whether err is AWS telling us that a call made with
+// the DryRun option would otherwise have succeeded.
+func isDryRun(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == DryRun
+}
+
+// deleteResource logs the outcome of a delete call made with DryRun set
+// when we aren't deleting, and returns any error other than the one
+// telling us a dry run would have worked.
+func (p *PackerClean) deleteResource(kind, field, id string, err error) error {
+	switch {
+	case err == nil:
+		p.Logger.Info("Deleted "+kind,
+			zap.String(field, id),
+		)
+	case isDryRun(err):
+		p.Logger.Info("Would have deleted "+kind,
+			zap.String(field, id),
+		)
+	default:
+		p.Logger.Error("Error attempting to delete "+kind,
+			zap.String(field, id),
+			zap.Error(err),
+		)
+		return err
 	}
-	output, err := p.EC2Client.DescribeInstances(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				p.Logger.Error("Encountered AWS error attempting to get instance list",
-					zap.Error(aerr),
-				)
+	return nil
+}
+
+// rules returns the match rules in effect.
+func (p *PackerClean) rules() MatchRules {
+	if p.Rules.IsEmpty() {
+		return DefaultMatchRules
+	}
+	return p.Rules
+}
+
+// InstanceClass is what we make of a Packer instance based on its age
+// and state.
+type InstanceClass string
+
+const (
+	// InstanceClassActive instances are younger than the expiration
+	// date, so they may well still be building.
+	InstanceClassActive InstanceClass = "active"
+	// InstanceClassAbandoned instances are pending or running past
+	// the expiration date.
+	InstanceClassAbandoned InstanceClass = "abandoned"
+	// InstanceClassStopped instances were stopped and left behind
+	// past the expiration date, usually because Packer died partway
+	// through creating an image.
+	InstanceClassStopped InstanceClass = "stopped"
+	// InstanceClassOverdue instances are past the warning date but not
+	// yet the expiration date, or past both without having been warned
+	// about; whoever started them gets a warning.
+	InstanceClassOverdue InstanceClass = "overdue"
+	// InstanceClassKept instances have the KeepTag, and are never
+	// touched.
+	InstanceClassKept InstanceClass = "kept"
+)
+
+const (
+	// KeepTag exempts an instance from the janitor entirely, whatever
+	// its value.
+	KeepTag = "packer-janitor:keep"
+	// WarnedTag records when we warned about an overdue instance, so
+	// that we only do it once. Its value is an RFC 3339 time.
+	WarnedTag = "packer-janitor:warned"
+)
+
+// ownerTags are the tags we look at, in order, to find out who started an
+// instance.
+var ownerTags = []string{"Owner", "CreatedBy"}
+
+// hasTag reports whether an instance has a tag set, to any value.
+func hasTag(instance *ec2.Instance, key string) bool {
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// InstanceOwner returns whoever the Owner or CreatedBy tag says started
+// an instance, or an empty string if it has neither.
+func InstanceOwner(instance *ec2.Instance) string {
+	for _, key := range ownerTags {
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == key && aws.StringValue(tag.Value) != "" {
+				return *tag.Value
 			}
-		} else {
-			p.Logger.Error("Error while attempting to get instance list",
-				zap.Error(err),
-			)
-			return nil, err
 		}
 	}
+	return ""
+}
+
+// packerInstanceStates are the instance states we look for; instances
+// that are already shutting down or terminated can't be terminated
+// again, and there's nothing to clean up until they're gone.
+var packerInstanceStates = []string{
+	ec2.InstanceStateNamePending,
+	ec2.InstanceStateNameRunning,
+	ec2.InstanceStateNameStopped,
+}
+
+// ClassifyInstance decides whether a Packer instance has been abandoned
+// by looking at its tags, launch time and state. If there's a warning
+// stage, an instance isn't abandoned until we've warned about it, even if
+// it's already past the expiration date; it's overdue instead, and can go
+// on a later run. That is, unless it's past the UnwarnedDate too.
+func (p *PackerClean) ClassifyInstance(instance *ec2.Instance) InstanceClass {
+	if hasTag(instance, KeepTag) {
+		return InstanceClassKept
+	}
+	if instance.LaunchTime == nil {
+		return InstanceClassActive
+	}
+	warnings := !p.WarningDate.IsZero()
+	if !instance.LaunchTime.Before(p.ExpirationDate) {
+		if warnings && instance.LaunchTime.Before(p.WarningDate) {
+			return InstanceClassOverdue
+		}
+		return InstanceClassActive
+	}
+	if warnings && !hasTag(instance, WarnedTag) && !instance.LaunchTime.Before(p.UnwarnedDate) {
+		return InstanceClassOverdue
+	}
+	return expiredClass(instance)
+}
+
+// expiredClass is what we make of an instance that's past the expiration
+// date, once we're done warning about it.
+func expiredClass(instance *ec2.Instance) InstanceClass {
+	if instanceState(instance) == ec2.InstanceStateNameStopped {
+		return InstanceClassStopped
+	}
+	return InstanceClassAbandoned
+}
+
+// GetPackerInstances -- find all pending, running or stopped instances
+// that match our rules for builders and are older than X and returns
+// them in a list
+func (p *PackerClean) GetPackerInstances() ([]*ec2.Instance, error) {
+	instanceList, _, err := p.FindPackerInstances()
+	return instanceList, err
+}
+
+// FindPackerInstances finds all the pending, running or stopped instances
+// that match our rules for builders, and returns the ones that are past
+// the expiration date, which should be purged, and the ones that are past
+// the warning date that we haven't warned about yet.
+func (p *PackerClean) FindPackerInstances() ([]*ec2.Instance, []*ec2.Instance, error) {
+	rules := p.rules()
+	stateFilter := &ec2.Filter{
+		Name:   aws.String("instance-state-name"),
+		Values: aws.StringSlice(packerInstanceStates),
+	}
+	input := &ec2.DescribeInstancesInput{
+		// Whatever we can't filter on here, we check with
+		// rules.Match below.
+		Filters: append(rules.filters(), stateFilter),
+	}
 
 	// The output gives us reservations; we need to get the actual
 	// instances out of them, and look to make sure they are older
 	// than the time we're looking for.
-	var instanceList []*ec2.Instance
-
-	for _, reservation := range output.Reservations {
-		for _, instance := range reservation.Instances {
-			// We need to check if the instance is older
-			// than our expiration, because we can't do
-			// that comparison in a filter above. :/
-			instanceLaunchTime := *instance.LaunchTime
-			if instanceLaunchTime.Before(p.ExpirationDate) {
-				instanceList = append(instanceList, instance)
+	var instanceList, overdueList []*ec2.Instance
+
+	err := p.EC2Client.DescribeInstancesPages(input,
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					if !rules.Match(instance) {
+						continue
+					}
+					// We need to check if the instance is
+					// older than our expiration, because we
+					// can't do that comparison in a filter
+					// above. :/
+					class := p.ClassifyInstance(instance)
+					switch class {
+					case InstanceClassActive:
+						continue
+					case InstanceClassKept:
+						p.Logger.Info("Keeping Packer instance with keep tag",
+							zap.String("instance-id", aws.StringValue(instance.InstanceId)),
+						)
+						continue
+					case InstanceClassOverdue:
+						if !hasTag(instance, WarnedTag) {
+							overdueList = append(overdueList, instance)
+						}
+						// A dry run never marks instances
+						// as warned, so it would never get
+						// as far as terminating one past the
+						// expiration date. We report what a
+						// real run would do once it had
+						// warned about it instead.
+						if p.Delete || !instance.LaunchTime.Before(p.ExpirationDate) {
+							continue
+						}
+						class = expiredClass(instance)
+					}
+					p.Logger.Info("Found abandoned Packer instance",
+						zap.String("instance-id", aws.StringValue(instance.InstanceId)),
+						zap.String("class", string(class)),
+						zap.String("state", instanceState(instance)),
+						zap.Time("launch-time", *instance.LaunchTime),
+					)
+					instanceList = append(instanceList, instance)
+				}
 			}
-		}
+			return true
+		})
+	if err != nil {
+		p.Logger.Error("Error while attempting to get instance list",
+			zap.Error(err),
+		)
+		return nil, nil, err
 	}
 
-	return instanceList, nil
+	return instanceList, overdueList, nil
 
 }
 
-// CleanTerminateInstance -- Terminates an instance and waits until it is
-// gone before returning.
-func (p *PackerClean) CleanTerminateInstance(instance *ec2.Instance) error {
-	terminateInput := &ec2.TerminateInstancesInput{
-		DryRun:      aws.Bool(!p.Delete),
-		InstanceIds: []*string{instance.InstanceId},
-	}
-	_, err := p.EC2Client.TerminateInstances(terminateInput)
-	if err != nil {
-		// Check to see if this was an AWS error
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			// If this was a dryrun operation, we want to
-			// log that we would have succeeded and keep
-			// going.
-			case DryRun:
-				p.Logger.Info("Would have terminated instance",
-					zap.String("instance-id", *instance.InstanceId),
-					zap.Error(aerr),
-				)
-			default:
-				p.Logger.Error("Encountered AWS Error attempting to terminate instance",
-					zap.String("instance-id", *instance.InstanceId),
-					zap.Error(aerr),
-				)
-				return aerr
-			}
+// WarnOwners warns the owners of overdue instances by calling warn, and
+// then marks the instances with the WarnedTag. We mark them even if the
+// warning fails, since once we've tried, an instance that's past the
+// expiration date should go on the next run rather than wait on a
+// warning that may never work. In a dry run, we just log who we would
+// have warned.
+func (p *PackerClean) WarnOwners(instances []*ec2.Instance, warn func([]*ec2.Instance) error) error {
+	for _, instance := range instances {
+		fields := []zap.Field{
+			zap.String("instance-id", aws.StringValue(instance.InstanceId)),
+			zap.Time("launch-time", aws.TimeValue(instance.LaunchTime)),
+			zap.String("owner", InstanceOwner(instance)),
+		}
+		if p.Delete {
+			p.Logger.Info("Warning about overdue Packer instance", fields...)
 		} else {
-			p.Logger.Error("Error while attempting to terminate instance",
-				zap.String("instance-id", *instance.InstanceId),
-				zap.Error(err),
-			)
-			return err
+			p.Logger.Info("Would have warned about overdue Packer instance", fields...)
 		}
 	}
-
-	// If we were able to terminate the instance, wait for it to be
-	// terminated. If we're in a dry run, just return right away.
 	if !p.Delete {
 		return nil
 	}
 
-	describeInput := &ec2.DescribeInstancesInput{
-		DryRun: aws.Bool(!p.Delete),
-		Filters: []*ec2.Filter{{
-			Name:   aws.String("instance-id"),
-			Values: []*string{instance.InstanceId},
-		},
+	warnErr := warn(instances)
+	markErr := p.MarkWarned(instances)
+	switch {
+	case warnErr != nil && markErr != nil:
+		return fmt.Errorf("unable to warn about Packer instances: %v; unable to mark them as warned: %v", warnErr, markErr)
+	case warnErr != nil:
+		return fmt.Errorf("unable to warn about Packer instances, marked them as warned anyway: %v", warnErr)
+	case markErr != nil:
+		return fmt.Errorf("unable to mark Packer instances as warned: %v", markErr)
+	}
+	return nil
+}
+
+// MarkWarned tags instances with the WarnedTag once their owners have
+// been warned about them.
+func (p *PackerClean) MarkWarned(instances []*ec2.Instance) error {
+	var ids []*string
+	for _, instance := range instances {
+		ids = append(ids, instance.InstanceId)
+	}
+	_, err := p.EC2Client.CreateTags(&ec2.CreateTagsInput{
+		DryRun:    aws.Bool(!p.Delete),
+		Resources: ids,
+		Tags: []*ec2.Tag{
+			{Key: aws.String(WarnedTag), Value: aws.String(p.now().Format(time.RFC3339))},
 		},
+	})
+	if err != nil && !isDryRun(err) {
+		return err
 	}
-	err = p.EC2Client.WaitUntilInstanceTerminated(describeInput)
+	return nil
+}
+
+// instanceState returns the name of the state an instance is in.
+func instanceState(instance *ec2.Instance) string {
+	if instance.State == nil {
+		return ""
+	}
+	return aws.StringValue(instance.State.Name)
+}
+
+// CleanTerminateInstance -- Terminates an instance and waits until it is
+// gone before returning.
+func (p *PackerClean) CleanTerminateInstance(instance *ec2.Instance) error {
+	ctx := context.Background()
+	err := p.TerminateInstances(ctx, []*ec2.Instance{instance})[0]
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				p.Logger.Error("Encountered AWS error waiting for instance to terminate",
-					zap.String("instance-id", *instance.InstanceId),
-					zap.Error(aerr),
-				)
-				return aerr
-			}
-		} else {
-			p.Logger.Error("Error while waiting for instance to terminate",
+		return err
+	}
+	return p.waitUntilTerminated(ctx, instance)
+}
+
+// PurgePackerResource -- takes an instance, terminates it, waits until
+// it is dead, and then deletes the key pair and security groups Packer
+// created for it. This is PurgePackerResources for a single instance,
+// with no time limit.
+func (p *PackerClean) PurgePackerResource(instance *ec2.Instance) error {
+	return p.PurgePackerResources(context.Background(), []*ec2.Instance{instance})[0].Error
+}
+
+// deleteInstanceResources deletes the key pair and security groups
+// Packer created for an instance that has been terminated.
+func (p *PackerClean) deleteInstanceResources(instance *ec2.Instance) error {
+	var err error
+	rules := p.orphanRules()
+
+	// Now that the instance is terminated, let's clean up the
+	// keypair. We carry on to the security groups even if this
+	// fails, so that we get as much cleaned up as we can.
+	keyName := aws.StringValue(instance.KeyName)
+	switch {
+	case keyName == "":
+		p.Logger.Info("Instance has no keypair to delete",
+			zap.String("instance-id", *instance.InstanceId),
+		)
+	case !rules.matchKeyName(keyName):
+		p.Logger.Info("Not deleting keypair Packer didn't create",
+			zap.String("instance-id", *instance.InstanceId),
+			zap.String("keypair", keyName),
+		)
+	default:
+		if deleteErr := p.DeleteKeyPair(instance.KeyName); deleteErr != nil {
+			err = deleteErr
+		}
+	}
+
+	// We should also clean up the security groups Packer made for
+	// the instance.
+	for _, group := range instance.SecurityGroups {
+		if !rules.MatchSecurityGroupName(aws.StringValue(group.GroupName)) {
+			p.Logger.Info("Not deleting security group Packer didn't create",
 				zap.String("instance-id", *instance.InstanceId),
-				zap.Error(err),
+				zap.String("security-group", aws.StringValue(group.GroupId)),
+				zap.String("security-group-name", aws.StringValue(group.GroupName)),
 			)
-			return err
+			continue
+		}
+		if deleteErr := p.DeleteSecurityGroup(group.GroupId); deleteErr != nil {
+			err = deleteErr
 		}
 	}
 
-	// Once the instance has terminated, we can return a success.
-	return nil
+	return err
+}
+
+// maxTerminateInstances is the most instances we ask EC2 to terminate in
+// one call.
+const maxTerminateInstances = 1000
 
+// PurgeResult is what happened when we tried to purge a Packer instance.
+// Unfinished is set if we ran out of time before we were done with it.
+type PurgeResult struct {
+	Instance   *ec2.Instance
+	Error      error
+	Unfinished bool
 }
 
-// PurgePackerResource -- takes an instance, collects the key and SG
-// for it, terminates the instance, waits until it is dead, and then
-// deletes the key pair and security group.
-func (p *PackerClean) PurgePackerResource(instance *ec2.Instance) error {
-	// First, we need to terminate the instance and wait for it
-	// to die; we can't delete security groups if an instance is
-	// still running with it.
-	err := p.CleanTerminateInstance(instance)
-	if err != nil {
-		p.Logger.Error("Failed to terminate instance",
-			zap.String("instance-id", *instance.InstanceId),
+// TerminateInstances terminates instances in as few calls as we can,
+// without waiting for them to finish terminating. EC2 turns down the
+// whole call if it can't terminate any one of the instances in it, so
+// when a batch fails we go back through it one instance at a time, so
+// that one bad instance doesn't hold up the rest. We return an error for
+// each instance, which is nil if it's terminating.
+func (p *PackerClean) TerminateInstances(ctx context.Context, instances []*ec2.Instance) []error {
+	errs := make([]error, len(instances))
+	for start := 0; start < len(instances); start += maxTerminateInstances {
+		end := start + maxTerminateInstances
+		if end > len(instances) {
+			end = len(instances)
+		}
+		batch := instances[start:end]
+		var ids []*string
+		for _, instance := range batch {
+			ids = append(ids, instance.InstanceId)
+		}
+
+		// Mark the volumes the builders will leave behind, so that
+		// SweepLeftovers can find them later. A volume we couldn't
+		// mark only gets left alone, so we terminate either way.
+		if markErr := p.MarkBuilderVolumes(batch); markErr != nil {
+			p.Logger.Warn("Terminating instances without marking all their volumes",
+				zap.Strings("instance-ids", aws.StringValueSlice(ids)),
+			)
+		}
+
+		err := p.terminate(ctx, ids)
+		if err == nil {
+			continue
+		}
+		if len(batch) == 1 || ctx.Err() != nil {
+			for i := start; i < end; i++ {
+				errs[i] = err
+			}
+			continue
+		}
+		p.Logger.Info("Terminating instances one at a time",
+			zap.Strings("instance-ids", aws.StringValueSlice(ids)),
+		)
+		for i, instance := range batch {
+			errs[start+i] = p.terminate(ctx, []*string{instance.InstanceId})
+		}
+	}
+	return errs
+}
+
+// terminate makes a single TerminateInstances call, and logs how it went.
+func (p *PackerClean) terminate(ctx context.Context, ids []*string) error {
+	_, err := p.EC2Client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		DryRun:      aws.Bool(!p.Delete),
+		InstanceIds: ids,
+	})
+	switch {
+	case err == nil:
+		p.Logger.Info("Terminating instances",
+			zap.Strings("instance-ids", aws.StringValueSlice(ids)),
+		)
+	case isDryRun(err):
+		p.Logger.Info("Would have terminated instances",
+			zap.Strings("instance-ids", aws.StringValueSlice(ids)),
+		)
+	default:
+		p.Logger.Error("Error while attempting to terminate instances",
+			zap.Strings("instance-ids", aws.StringValueSlice(ids)),
 			zap.Error(err),
 		)
 		return err
 	}
+	return nil
+}
 
-	// Now that the instance is terminated, let's clean up the
-	// keypair.
-	deleteKeyInput := &ec2.DeleteKeyPairInput{
-		DryRun:  aws.Bool(!p.Delete),
-		KeyName: instance.KeyName,
+// PurgePackerResources purges a batch of instances: they're all
+// terminated at once, and then up to Workers of the ones that are
+// terminating at a time are waited on and have their key pairs and
+// security groups deleted. An instance we couldn't terminate is reported
+// as failed without holding up the rest. If ctx is done
+// before we've finished, we stop and report the instances we didn't get
+// to as unfinished, so that a Lambda function can say what's left before
+// it runs out of time.
+func (p *PackerClean) PurgePackerResources(ctx context.Context, instances []*ec2.Instance) []*PurgeResult {
+	results := make([]*PurgeResult, len(instances))
+
+	for i, err := range p.TerminateInstances(ctx, instances) {
+		if err != nil {
+			results[i] = &PurgeResult{Instance: instances[i], Error: err, Unfinished: ctx.Err() != nil}
+		}
 	}
-	_, err = p.EC2Client.DeleteKeyPair(deleteKeyInput)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			// If we were doing this as a dry run, just log
-			// that we would have deleted it and continue.
-			case DryRun:
-				p.Logger.Info("Would have deleted keypair",
-					zap.String("keypair", *instance.KeyName),
-					zap.Error(aerr),
-				)
-			default:
-				p.Logger.Error("Encountered AWS error while deleting keypair",
-					zap.String("keypair", *instance.KeyName),
-					zap.Error(aerr),
-				)
-				return aerr
+
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = p.purgeTerminated(ctx, instances[i])
 			}
-		} else {
-			p.Logger.Error("Error while attempting to delete keypair",
-				zap.String("keypair", *instance.KeyName),
-				zap.Error(err),
-			)
-			return err
+		}()
+	}
+
+queue:
+	for i := range instances {
+		if results[i] != nil {
+			continue
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break queue
 		}
 	}
+	close(jobs)
+	wg.Wait()
 
-	// We should also clean up the security group used by the
-	// instance.
-	deleteSGInput := &ec2.DeleteSecurityGroupInput{
-		DryRun: aws.Bool(!p.Delete),
-		// There should only be a single security group for a
-		// Packer instance, so we can get the first one from
-		// this list.
-		GroupId: instance.SecurityGroups[0].GroupId,
+	for i, instance := range instances {
+		if results[i] == nil {
+			results[i] = &PurgeResult{Instance: instance, Error: ctx.Err(), Unfinished: true}
+		}
 	}
-	_, err = p.EC2Client.DeleteSecurityGroup(deleteSGInput)
+	return results
+}
+
+// purgeTerminated waits for an instance we've asked EC2 to terminate to
+// be gone, and then deletes its key pair and security groups.
+func (p *PackerClean) purgeTerminated(ctx context.Context, instance *ec2.Instance) *PurgeResult {
+	result := &PurgeResult{Instance: instance}
+	if ctx.Err() != nil {
+		result.Error = ctx.Err()
+		result.Unfinished = true
+		return result
+	}
+
+	err := p.waitUntilTerminated(ctx, instance)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			// Same thing here as the rest; if we are in
-			// a dryrun, handwave our success.
-			case DryRun:
-				p.Logger.Info("Would have deleted security group",
-					zap.String("security-group", *instance.SecurityGroups[0].GroupId),
-					zap.Error(aerr),
-				)
-			default:
-				p.Logger.Error("Encountered AWS error while deleting security group",
-					zap.String("security-group", *instance.SecurityGroups[0].GroupId),
-					zap.Error(aerr),
-				)
-				return aerr
-			}
-		} else {
-			p.Logger.Error("Error attempting to delete security group",
-				zap.String("security-group", *instance.SecurityGroups[0].GroupId),
-				zap.Error(err),
-			)
-			return err
-		}
+		result.Error = err
+		result.Unfinished = ctx.Err() != nil
+		return result
 	}
 
-	return nil
+	result.Error = p.deleteInstanceResources(instance)
+	return result
+}
 
+// waitUntilTerminated waits for an instance we've asked EC2 to terminate
+// to be gone. If we're in a dry run, nothing is terminating, so there's
+// nothing to wait for.
+func (p *PackerClean) waitUntilTerminated(ctx context.Context, instance *ec2.Instance) error {
+	if !p.Delete {
+		return nil
+	}
+	describeInput := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{instance.InstanceId},
+	}
+	err := p.EC2Client.WaitUntilInstanceTerminatedWithContext(ctx, describeInput)
+	if err != nil {
+		p.Logger.Error("Error while waiting for instance to terminate",
+			zap.String("instance-id", *instance.InstanceId),
+			zap.Error(err),
+		)
+	}
+	return err
 }
@@ -1,18 +1,30 @@
 package packerjanitor
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"go.uber.org/zap"
 )
 
 // We set up a mock EC2Client so that we can mock API calls for our code.
+// It records the key pairs and security groups we delete, along with
+// anything else the mocks that embed it delete, and the tags we add.
 type mockEC2Client struct {
 	ec2iface.EC2API
+	mu      sync.Mutex
+	deleted []string
+	tagged  []string
 }
 
 // Setting the time "now" to be midnight on 1 July 2019
@@ -29,8 +41,9 @@ var packerInstanceOld = &ec2.Instance{
 	KeyName:    aws.String("packer_1234"),
 	LaunchTime: aws.Time(time.Date(2019, 6, 30, 0, 0, 0, 0, time.UTC)),
 	InstanceId: aws.String("i-11111111111111111"),
+	State:      &ec2.InstanceState{Name: aws.String("running")},
 	SecurityGroups: []*ec2.GroupIdentifier{
-		{GroupId: aws.String("sg-11111111111111111")},
+		{GroupId: aws.String("sg-11111111111111111"), GroupName: aws.String("packer_1111")},
 	},
 }
 
@@ -43,8 +56,9 @@ var packerInstanceAncient = &ec2.Instance{
 	KeyName:    aws.String("packer_1234"),
 	LaunchTime: aws.Time(time.Date(2019, 5, 31, 0, 0, 0, 0, time.UTC)),
 	InstanceId: aws.String("i-22222222222222222"),
+	State:      &ec2.InstanceState{Name: aws.String("running")},
 	SecurityGroups: []*ec2.GroupIdentifier{
-		{GroupId: aws.String("sg-22222222222222222")},
+		{GroupId: aws.String("sg-22222222222222222"), GroupName: aws.String("packer_2222")},
 	},
 }
 
@@ -57,11 +71,66 @@ var packerInstanceNew = &ec2.Instance{
 	KeyName:    aws.String("packer_6789"),
 	LaunchTime: aws.Time(time.Date(2019, 6, 30, 23, 59, 0, 0, time.UTC)),
 	InstanceId: aws.String("i-33333333333333333"),
+	State:      &ec2.InstanceState{Name: aws.String("pending")},
 	SecurityGroups: []*ec2.GroupIdentifier{
-		{GroupId: aws.String("sg-33333333333333333")},
+		{GroupId: aws.String("sg-33333333333333333"), GroupName: aws.String("packer_3333")},
 	},
 }
 
+// This is a Packer instance that was stopped a day ago, which happens
+// when Packer dies while it's creating an image; it should be culled too.
+var packerInstanceStopped = &ec2.Instance{
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+	},
+	KeyName:    aws.String("packer_4321"),
+	LaunchTime: aws.Time(time.Date(2019, 6, 30, 0, 0, 0, 0, time.UTC)),
+	InstanceId: aws.String("i-44444444444444444"),
+	State:      &ec2.InstanceState{Name: aws.String("stopped")},
+	SecurityGroups: []*ec2.GroupIdentifier{
+		{GroupId: aws.String("sg-44444444444444444"), GroupName: aws.String("packer_4444")},
+	},
+}
+
+// This is a Packer instance that is two hours old, which is past the
+// warning limit in our tests but not the time limit.
+var packerInstanceOverdue = &ec2.Instance{
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+		{Key: aws.String("CreatedBy"), Value: aws.String("builder@example.com")},
+	},
+	KeyName:    aws.String("packer_5678"),
+	LaunchTime: aws.Time(time.Date(2019, 6, 30, 22, 0, 0, 0, time.UTC)),
+	InstanceId: aws.String("i-55555555555555555"),
+	State:      &ec2.InstanceState{Name: aws.String("running")},
+}
+
+// This is the same, but we've already warned about it.
+var packerInstanceWarned = &ec2.Instance{
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+		{Key: aws.String(WarnedTag), Value: aws.String("2019-06-30T23:00:00Z")},
+	},
+	KeyName:    aws.String("packer_8765"),
+	LaunchTime: aws.Time(time.Date(2019, 6, 30, 22, 0, 0, 0, time.UTC)),
+	InstanceId: aws.String("i-66666666666666666"),
+	State:      &ec2.InstanceState{Name: aws.String("running")},
+}
+
+// This is a day-old Packer instance someone is debugging, and has told
+// us to keep.
+var packerInstanceKept = &ec2.Instance{
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+		{Key: aws.String("Owner"), Value: aws.String("debugger")},
+		{Key: aws.String(KeepTag), Value: aws.String("")},
+	},
+	KeyName:    aws.String("packer_9999"),
+	LaunchTime: aws.Time(time.Date(2019, 6, 30, 0, 0, 0, 0, time.UTC)),
+	InstanceId: aws.String("i-77777777777777777"),
+	State:      &ec2.InstanceState{Name: aws.String("running")},
+}
+
 // This is a helper function for testing whether two slices of instances
 // are the same (including order).
 func sliceEqual(a, b []*ec2.Instance) bool {
@@ -82,55 +151,82 @@ func sliceEqual(a, b []*ec2.Instance) bool {
 	return true
 }
 
-// Here we're mocking the DescribeInstances call that we'll be using in
-// the GetPackerInstances() function test; we are assuming that our
-// filtering (based on the tag) will work, so all this does is check that
-// the tag in the DescribeInstancesInput filter is set correctly.
-func (m *mockEC2Client) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
-	// There should really be only one filter we're using here, the
-	// tag for the Name being "Packer Builder". Making this
-	// assumption makes this code much simpler (we don't have to
-	// iterate through all the filters).
-	if *input.Filters[0].Name == "tag:Name" && *input.Filters[0].Values[0] == "Packer Builder" {
-		output := &ec2.DescribeInstancesOutput{
-			NextToken: aws.String(""),
-			// I'm splitting these up into two reservations
-			// to test the looping.
+// Here we're mocking the DescribeInstancesPages call that we'll be using
+// in the GetPackerInstances() function test; we are assuming that our
+// filtering (based on the tag and state) will work, so all this does is
+// check that the filters in the DescribeInstancesInput are set correctly.
+func (m *mockEC2Client) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	filters := map[string][]string{}
+	for _, filter := range input.Filters {
+		filters[*filter.Name] = aws.StringValueSlice(filter.Values)
+	}
+	if !reflect.DeepEqual(filters["tag:Name"], []string{"Packer Builder"}) ||
+		!reflect.DeepEqual(filters["instance-state-name"], []string{"pending", "running", "stopped"}) {
+		fn(&ec2.DescribeInstancesOutput{}, true)
+		return nil
+	}
+
+	// I'm splitting these up into two pages, and the second page into
+	// two reservations, to test the looping.
+	pages := []*ec2.DescribeInstancesOutput{
+		{
+			NextToken: aws.String("page2"),
 			Reservations: []*ec2.Reservation{
 				{Instances: []*ec2.Instance{packerInstanceOld}},
+			},
+		},
+		{
+			Reservations: []*ec2.Reservation{
 				{Instances: []*ec2.Instance{packerInstanceNew, packerInstanceAncient}},
+				{Instances: []*ec2.Instance{packerInstanceStopped}},
+				{Instances: []*ec2.Instance{packerInstanceOverdue, packerInstanceWarned, packerInstanceKept}},
 			},
-		}
-		return output, nil
+		},
 	}
-
-	output := &ec2.DescribeInstancesOutput{
-		NextToken:    aws.String(""),
-		Reservations: []*ec2.Reservation{},
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
 	}
-
-	return output, nil
+	return nil
 }
 
 // With the following functions, we're just looking to make sure we're
 // using the right inputs and outputs, and that we're not getting errors.
 // For a successful test, then, we can just have these be pretty dumb.
-func (m *mockEC2Client) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+func (m *mockEC2Client) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
 	return nil, nil
 }
 
-func (m *mockEC2Client) WaitUntilInstanceTerminated(input *ec2.DescribeInstancesInput) error {
+func (m *mockEC2Client) WaitUntilInstanceTerminatedWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.WaiterOption) error {
 	return nil
 }
 
 func (m *mockEC2Client) DeleteKeyPair(input *ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+	m.record(*input.KeyName)
 	return nil, nil
 }
 
 func (m *mockEC2Client) DeleteSecurityGroup(input *ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+	m.record(*input.GroupId)
+	return nil, nil
+}
+
+func (m *mockEC2Client) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	for _, id := range input.Resources {
+		m.tagged = append(m.tagged, *id+"="+*input.Tags[0].Key)
+	}
 	return nil, nil
 }
 
+// record notes that we deleted something. We purge instances in
+// parallel, so it takes the lock.
+func (m *mockEC2Client) record(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, id)
+}
+
 // This is a helper function to generate a new PackerClean object;
 // we're doing this so that creating a new instance is easy if we
 // want to test with various mock EC2 clients.
@@ -151,7 +247,7 @@ func TestGetPackerInstancesSuccess(t *testing.T) {
 	// The resultSet we're looking here is all the Packer instances
 	// except the new one, which should get filtered out by the
 	// ExpirationDate in GetPackerInstances.
-	resultSet := []*ec2.Instance{packerInstanceOld, packerInstanceAncient}
+	resultSet := []*ec2.Instance{packerInstanceOld, packerInstanceAncient, packerInstanceStopped}
 
 	p := testPackerClean(&mockEC2Client{})
 
@@ -168,6 +264,56 @@ func TestGetPackerInstancesSuccess(t *testing.T) {
 	}
 }
 
+// This mock EC2Client fails to describe instances, the way AWS does when
+// we don't have permission to.
+type mockEC2ClientDescribeError struct {
+	mockEC2Client
+}
+
+func (m *mockEC2ClientDescribeError) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	return awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+}
+
+// This function makes sure GetPackerInstances hands AWS errors back
+// rather than carrying on without a list of instances.
+func TestGetPackerInstancesError(t *testing.T) {
+	p := testPackerClean(&mockEC2ClientDescribeError{})
+
+	testSet, err := p.GetPackerInstances()
+
+	if err == nil {
+		t.Errorf("ERROR: GetPackerInstances did not return error from DescribeInstances")
+	}
+
+	if testSet != nil {
+		t.Errorf("ERROR: GetPackerInstances returned instances after error: %v", testSet)
+	}
+}
+
+func TestClassifyInstance(t *testing.T) {
+	tables := []struct {
+		instance *ec2.Instance
+		class    InstanceClass
+	}{
+		{packerInstanceOld, InstanceClassAbandoned},
+		{packerInstanceAncient, InstanceClassAbandoned},
+		{packerInstanceNew, InstanceClassActive},
+		{packerInstanceStopped, InstanceClassStopped},
+		{packerInstanceOverdue, InstanceClassActive},
+		{packerInstanceKept, InstanceClassKept},
+		{&ec2.Instance{InstanceId: aws.String("i-55555555555555555")}, InstanceClassActive},
+	}
+
+	p := testPackerClean(&mockEC2Client{})
+	for _, table := range tables {
+		class := p.ClassifyInstance(table.instance)
+		if class != table.class {
+			t.Errorf("ERROR: ClassifyInstance for %v;\n\texpected: %v\n\tgot: %v",
+				*table.instance.InstanceId, table.class, class)
+		}
+	}
+}
+
 // This function exercises the successful functioning of the
 // CleanTerminateInstance function.
 func TestCleanTerminateInstanceSuccess(t *testing.T) {
@@ -187,3 +333,816 @@ func TestPurgePackerResourceSuccess(t *testing.T) {
 		t.Errorf("ERROR: PurgePackerResource threw error during successful test")
 	}
 }
+
+func TestParseTagRule(t *testing.T) {
+	tables := []struct {
+		rule  string
+		key   string
+		value string
+		err   bool
+	}{
+		{"Name=Packer Builder", "Name", "Packer Builder", false},
+		{"Builder", "Builder", "", false},
+		{"Purpose=ci=runner", "Purpose", "ci=runner", false},
+		{"=Packer Builder", "", "", true},
+	}
+
+	for _, table := range tables {
+		tag, err := ParseTagRule(table.rule)
+		if (err != nil) != table.err {
+			t.Errorf("ERROR: ParseTagRule for %q returned error %v", table.rule, err)
+			continue
+		}
+		if err == nil && (*tag.Key != table.key || *tag.Value != table.value) {
+			t.Errorf("ERROR: ParseTagRule for %q;\n\texpected: %v=%v\n\tgot: %v=%v",
+				table.rule, table.key, table.value, *tag.Key, *tag.Value)
+		}
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	ciRunner := &ec2.Instance{
+		InstanceId: aws.String("i-66666666666666666"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("ci-runner-1")},
+			{Key: aws.String("Ephemeral"), Value: aws.String("true")},
+		},
+		SecurityGroups: []*ec2.GroupIdentifier{
+			{GroupId: aws.String("sg-66666666666666666"), GroupName: aws.String("default")},
+		},
+	}
+	imageBuilder := &ec2.Instance{
+		InstanceId: aws.String("i-77777777777777777"),
+		SecurityGroups: []*ec2.GroupIdentifier{
+			{GroupId: aws.String("sg-77777777777777777"), GroupName: aws.String("default")},
+			{GroupId: aws.String("sg-77777777777777778"), GroupName: aws.String("image-builder-abc123")},
+		},
+	}
+	instances := []*ec2.Instance{packerInstanceOld, ciRunner, imageBuilder}
+
+	tables := []struct {
+		rules     MatchRules
+		resultSet []bool
+	}{
+		{DefaultMatchRules, []bool{true, false, false}},
+		{MatchRules{Tags: []*ec2.Tag{{Key: aws.String("Ephemeral"), Value: aws.String("")}}}, []bool{false, true, false}},
+		{MatchRules{Tags: []*ec2.Tag{{Key: aws.String("Ephemeral"), Value: aws.String("false")}}}, []bool{false, false, false}},
+		{MatchRules{KeyNamePrefixes: []string{"packer_"}}, []bool{true, false, false}},
+		{MatchRules{SecurityGroupPatterns: []string{"image-builder-*"}}, []bool{false, false, true}},
+		{MatchRules{
+			Tags:                  []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("ci-runner-1")}},
+			KeyNamePrefixes:       []string{"packer_"},
+			SecurityGroupPatterns: []string{"image-builder-*"},
+		}, []bool{true, true, true}},
+	}
+
+	for _, table := range tables {
+		for index, instance := range instances {
+			if table.rules.Match(instance) != table.resultSet[index] {
+				t.Errorf("ERROR: rules %+v, instance %v;\n\texpected: %v\n\tgot: %v",
+					table.rules, *instance.InstanceId, table.resultSet[index], !table.resultSet[index])
+			}
+		}
+	}
+}
+
+// We make sure the server-side filters never narrow things down further
+// than the rules themselves do.
+func TestMatchRulesFilters(t *testing.T) {
+	tables := []struct {
+		rules  MatchRules
+		result map[string][]string
+	}{
+		{DefaultMatchRules, map[string][]string{"tag:Name": {"Packer Builder"}}},
+		{MatchRules{Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+			{Key: aws.String("Name"), Value: aws.String("ci-runner*")},
+		}}, map[string][]string{"tag:Name": {"Packer Builder", `ci-runner\*`}}},
+		{MatchRules{Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+			{Key: aws.String("Purpose"), Value: aws.String("ci")},
+		}}, map[string][]string{}},
+		{MatchRules{Tags: []*ec2.Tag{{Key: aws.String("Ephemeral"), Value: aws.String("")}}}, map[string][]string{}},
+		{MatchRules{KeyNamePrefixes: []string{"packer_", "ci_"}}, map[string][]string{"key-name": {"packer_*", "ci_*"}}},
+		{MatchRules{SecurityGroupPatterns: []string{"packer_*"}}, map[string][]string{}},
+		{MatchRules{
+			Tags:            []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("Packer Builder")}},
+			KeyNamePrefixes: []string{"packer_"},
+		}, map[string][]string{}},
+	}
+
+	for _, table := range tables {
+		got := map[string][]string{}
+		for _, filter := range table.rules.filters() {
+			got[*filter.Name] = aws.StringValueSlice(filter.Values)
+		}
+		if !reflect.DeepEqual(got, table.result) {
+			t.Errorf("ERROR: rules %+v;\n\texpected: %v\n\tgot: %v", table.rules, table.result, got)
+		}
+	}
+}
+
+// This mock EC2Client has the key pairs, security groups and network
+// interfaces that Packer builds leave lying around, and records what we
+// tag and delete.
+type mockEC2ClientOrphans struct {
+	mockEC2Client
+	marked   []string
+	unmarked []string
+}
+
+func (m *mockEC2ClientOrphans) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	fn(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{Instances: []*ec2.Instance{{KeyName: aws.String("packer_inuse")}, {}}},
+		},
+	}, true)
+	return nil
+}
+
+func (m *mockEC2ClientOrphans) DescribeKeyPairs(input *ec2.DescribeKeyPairsInput) (*ec2.DescribeKeyPairsOutput, error) {
+	return &ec2.DescribeKeyPairsOutput{
+		KeyPairs: []*ec2.KeyPairInfo{
+			{KeyName: aws.String("packer_old"), CreateTime: aws.Time(time.Date(2019, 6, 30, 0, 0, 0, 0, time.UTC))},
+			{KeyName: aws.String("packer_new"), CreateTime: aws.Time(time.Date(2019, 6, 30, 23, 59, 0, 0, time.UTC))},
+			{KeyName: aws.String("packer_inuse"), CreateTime: aws.Time(time.Date(2019, 6, 30, 0, 0, 0, 0, time.UTC))},
+			{KeyName: aws.String("packer_legacy")},
+			{KeyName: aws.String("deploy"), CreateTime: aws.Time(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))},
+		},
+	}, nil
+}
+
+func (m *mockEC2ClientOrphans) DescribeNetworkInterfacesPages(input *ec2.DescribeNetworkInterfacesInput, fn func(*ec2.DescribeNetworkInterfacesOutput, bool) bool) error {
+	fn(&ec2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []*ec2.NetworkInterface{
+			{Groups: []*ec2.GroupIdentifier{{GroupId: aws.String("sg-00000000000000004")}}},
+		},
+	}, true)
+	return nil
+}
+
+func (m *mockEC2ClientOrphans) DescribeSecurityGroupsPages(input *ec2.DescribeSecurityGroupsInput, fn func(*ec2.DescribeSecurityGroupsOutput, bool) bool) error {
+	orphanedSince := func(since string) []*ec2.Tag {
+		return []*ec2.Tag{{Key: aws.String(OrphanedSinceTag), Value: aws.String(since)}}
+	}
+	fn(&ec2.DescribeSecurityGroupsOutput{
+		SecurityGroups: []*ec2.SecurityGroup{
+			{GroupId: aws.String("sg-00000000000000001"), GroupName: aws.String("packer_unmarked")},
+			{GroupId: aws.String("sg-00000000000000002"), GroupName: aws.String("packer_marked_old"), Tags: orphanedSince("2019-06-30T00:00:00Z")},
+		},
+	}, false)
+	fn(&ec2.DescribeSecurityGroupsOutput{
+		SecurityGroups: []*ec2.SecurityGroup{
+			{GroupId: aws.String("sg-00000000000000003"), GroupName: aws.String("packer_marked_new"), Tags: orphanedSince("2019-06-30T23:00:00Z")},
+			{GroupId: aws.String("sg-00000000000000004"), GroupName: aws.String("packer_inuse"), Tags: orphanedSince("2019-06-30T00:00:00Z")},
+			{GroupId: aws.String("sg-00000000000000005"), GroupName: aws.String("default")},
+		},
+	}, true)
+	return nil
+}
+
+func (m *mockEC2ClientOrphans) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	m.marked = append(m.marked, aws.StringValueSlice(input.Resources)...)
+	return nil, nil
+}
+
+func (m *mockEC2ClientOrphans) DeleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	m.unmarked = append(m.unmarked, aws.StringValueSlice(input.Resources)...)
+	return nil, nil
+}
+
+// This function exercises finding and deleting the key pairs and
+// security groups Packer left behind without an instance.
+func TestSweepOrphans(t *testing.T) {
+	m := &mockEC2ClientOrphans{}
+	p := testPackerClean(m)
+	p.Now = now
+
+	keyPairs, err := p.GetOrphanedKeyPairs()
+	if err != nil {
+		t.Errorf("ERROR: GetOrphanedKeyPairs threw error during successful test")
+	}
+	var keyNames []string
+	for _, keyPair := range keyPairs {
+		keyNames = append(keyNames, *keyPair.KeyName)
+	}
+	expectedKeyNames := []string{"packer_old", "packer_legacy"}
+	if !reflect.DeepEqual(keyNames, expectedKeyNames) {
+		t.Errorf("ERROR: GetOrphanedKeyPairs;\n\texpected: %v\n\tgot: %v", expectedKeyNames, keyNames)
+	}
+
+	err = p.SweepOrphans(context.Background())
+	if err != nil {
+		t.Errorf("ERROR: SweepOrphans threw error during successful test")
+	}
+
+	// The unmarked group should have been marked, the one that's in use
+	// again unmarked, and only the group that has been orphaned for long
+	// enough deleted along with the key pairs.
+	tables := []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{"marked", m.marked, []string{"sg-00000000000000001"}},
+		{"unmarked", m.unmarked, []string{"sg-00000000000000004"}},
+		{"deleted", m.deleted, []string{"packer_old", "packer_legacy", "sg-00000000000000002"}},
+	}
+	for _, table := range tables {
+		if !reflect.DeepEqual(table.got, table.expected) {
+			t.Errorf("ERROR: SweepOrphans %v;\n\texpected: %v\n\tgot: %v", table.name, table.expected, table.got)
+		}
+	}
+}
+
+// This function makes sure a dry run reports every orphaned security
+// group, since it never marks them and so would never find one orphaned
+// for long enough.
+func TestGetOrphanedSecurityGroupsDryRun(t *testing.T) {
+	m := &mockEC2ClientOrphans{}
+	p := testPackerClean(m)
+	p.Delete = false
+	p.Now = now
+
+	groups, err := p.GetOrphanedSecurityGroups()
+	if err != nil {
+		t.Errorf("ERROR: GetOrphanedSecurityGroups threw error during dry run")
+	}
+	var groupIDs []string
+	for _, group := range groups {
+		groupIDs = append(groupIDs, *group.GroupId)
+	}
+	expected := []string{"sg-00000000000000001", "sg-00000000000000002", "sg-00000000000000003"}
+	if !reflect.DeepEqual(groupIDs, expected) {
+		t.Errorf("ERROR: GetOrphanedSecurityGroups during dry run;\n\texpected: %v\n\tgot: %v", expected, groupIDs)
+	}
+}
+
+// This mock EC2Client has the volumes, snapshots and network interfaces
+// aborted Packer builds leave behind, and records what we delete.
+type mockEC2ClientLeftovers struct {
+	mockEC2Client
+	marked []string
+}
+
+var packerTags = []*ec2.Tag{
+	{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+}
+
+var dayOld = aws.Time(time.Date(2019, 6, 30, 0, 0, 0, 0, time.UTC))
+
+func (m *mockEC2ClientLeftovers) DescribeVolumesPages(input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool) error {
+	builderTags := func(instanceID string) []*ec2.Tag {
+		return append([]*ec2.Tag{{Key: aws.String(BuilderTag), Value: aws.String(instanceID)}}, packerTags...)
+	}
+	fn(&ec2.DescribeVolumesOutput{
+		Volumes: []*ec2.Volume{
+			// The builder is gone, so this one should go.
+			{VolumeId: aws.String("vol-00000000000000001"), Tags: builderTags("i-00000000000000001"), CreateTime: dayOld},
+			// This one is too new.
+			{VolumeId: aws.String("vol-00000000000000002"), Tags: builderTags("i-00000000000000001"), CreateTime: aws.Time(now)},
+			// This one isn't Packer's.
+			{VolumeId: aws.String("vol-00000000000000003"), CreateTime: dayOld},
+			// We never saw its builder, which died between runs,
+			// but it has the tags, so it should go too.
+			{VolumeId: aws.String("vol-00000000000000004"), Tags: packerTags, CreateTime: dayOld},
+			// The builder is stopped, but still there.
+			{VolumeId: aws.String("vol-00000000000000005"), Tags: builderTags("i-44444444444444444"), CreateTime: dayOld},
+			// We marked this one, and its builder is gone, even
+			// though the template didn't tag it.
+			{VolumeId: aws.String("vol-00000000000000006"), Tags: []*ec2.Tag{{Key: aws.String(BuilderTag), Value: aws.String("i-00000000000000001")}}, CreateTime: dayOld},
+			// This one has the tags, but it's too new.
+			{VolumeId: aws.String("vol-00000000000000007"), Tags: packerTags, CreateTime: aws.Time(now)},
+		},
+	}, true)
+	return nil
+}
+
+func (m *mockEC2ClientLeftovers) DescribeImagesPages(input *ec2.DescribeImagesInput, fn func(*ec2.DescribeImagesOutput, bool) bool) error {
+	fn(&ec2.DescribeImagesOutput{
+		Images: []*ec2.Image{{
+			ImageId: aws.String("ami-00000000000000001"),
+			BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+				{Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-00000000000000002")}},
+				{VirtualName: aws.String("ephemeral0")},
+			},
+		}},
+	}, true)
+	return nil
+}
+
+// EC2 still remembers these instances, which were terminated a little
+// while ago; the first was a builder and the second wasn't.
+var terminatedInstances = []*ec2.Instance{
+	{
+		Tags:       packerTags,
+		InstanceId: aws.String("i-00000000000000009"),
+		State:      &ec2.InstanceState{Name: aws.String("terminated")},
+	},
+	{
+		InstanceId: aws.String("i-0000000000000000a"),
+		State:      &ec2.InstanceState{Name: aws.String("terminated")},
+	},
+}
+
+func (m *mockEC2ClientLeftovers) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	var ids []string
+	for _, filter := range input.Filters {
+		if *filter.Name == "instance-id" {
+			ids = aws.StringValueSlice(filter.Values)
+		}
+	}
+	if ids == nil {
+		fn(&ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{
+				{Instances: []*ec2.Instance{packerInstanceStopped, packerInstanceVolumes}},
+			},
+		}, true)
+		return nil
+	}
+
+	var instances []*ec2.Instance
+	for _, instance := range append([]*ec2.Instance{packerInstanceStopped, packerInstanceVolumes}, terminatedInstances...) {
+		for _, id := range ids {
+			if *instance.InstanceId == id {
+				instances = append(instances, instance)
+			}
+		}
+	}
+	fn(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: instances}},
+	}, true)
+	return nil
+}
+
+// This is a Packer instance with a volume it will leave behind, and one
+// that goes with it.
+var packerInstanceVolumes = &ec2.Instance{
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("Packer Builder")},
+	},
+	LaunchTime: aws.Time(time.Date(2019, 6, 30, 23, 0, 0, 0, time.UTC)),
+	InstanceId: aws.String("i-88888888888888888"),
+	State:      &ec2.InstanceState{Name: aws.String("running")},
+	BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{
+		{Ebs: &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-88888888888888881"), DeleteOnTermination: aws.Bool(true)}},
+		{Ebs: &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-88888888888888882"), DeleteOnTermination: aws.Bool(false)}},
+	},
+}
+
+func (m *mockEC2ClientLeftovers) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	for _, id := range input.Resources {
+		m.marked = append(m.marked, *id+"="+*input.Tags[0].Value)
+	}
+	return nil, nil
+}
+
+func (m *mockEC2ClientLeftovers) DescribeSnapshotsPages(input *ec2.DescribeSnapshotsInput, fn func(*ec2.DescribeSnapshotsOutput, bool) bool) error {
+	createImage := func(instanceID string) *string {
+		return aws.String("Created by CreateImage(" + instanceID + ") for ami-00000000000000009")
+	}
+	fn(&ec2.DescribeSnapshotsOutput{
+		Snapshots: []*ec2.Snapshot{
+			// The builder is gone, and it was taken from a volume
+			// we marked, so this one should go.
+			{SnapshotId: aws.String("snap-00000000000000001"), VolumeId: aws.String("vol-00000000000000001"), StartTime: dayOld, Description: createImage("i-00000000000000001")},
+			// This one is part of an image.
+			{SnapshotId: aws.String("snap-00000000000000002"), Tags: packerTags, StartTime: dayOld, Description: createImage("i-00000000000000001")},
+			// The builder is stopped, but still there.
+			{SnapshotId: aws.String("snap-00000000000000003"), Tags: packerTags, StartTime: dayOld, Description: createImage("i-44444444444444444")},
+			// This one is too new.
+			{SnapshotId: aws.String("snap-00000000000000004"), Tags: packerTags, StartTime: aws.Time(now)},
+			// This one isn't Packer's.
+			{SnapshotId: aws.String("snap-00000000000000005"), StartTime: dayOld},
+			// This one has the tags, but wasn't taken from a builder.
+			{SnapshotId: aws.String("snap-00000000000000006"), Tags: packerTags, StartTime: dayOld, Description: aws.String("Copied for DestinationAmi ami-00000000000000009")},
+			// Nor was this one.
+			{SnapshotId: aws.String("snap-00000000000000007"), Tags: packerTags, StartTime: dayOld},
+			// This one has no tags, but its builder was one of
+			// ours, and it's been terminated, so it should go.
+			{SnapshotId: aws.String("snap-00000000000000008"), StartTime: dayOld, Description: createImage("i-00000000000000009")},
+			// This one was taken from an instance that wasn't a
+			// builder.
+			{SnapshotId: aws.String("snap-00000000000000009"), Tags: packerTags, StartTime: dayOld, Description: createImage("i-0000000000000000a")},
+			// We don't know anything about this one's builder,
+			// even though it has the tags.
+			{SnapshotId: aws.String("snap-0000000000000000a"), Tags: packerTags, StartTime: dayOld, Description: createImage("i-0000000000000000b")},
+		},
+	}, true)
+	return nil
+}
+
+func (m *mockEC2ClientLeftovers) DescribeNetworkInterfacesPages(input *ec2.DescribeNetworkInterfacesInput, fn func(*ec2.DescribeNetworkInterfacesOutput, bool) bool) error {
+	fn(&ec2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []*ec2.NetworkInterface{
+			{
+				NetworkInterfaceId: aws.String("eni-00000000000000001"),
+				Groups:             []*ec2.GroupIdentifier{{GroupId: aws.String("sg-00000000000000001"), GroupName: aws.String("packer_1234")}},
+			},
+			{
+				NetworkInterfaceId: aws.String("eni-00000000000000002"),
+				Groups:             []*ec2.GroupIdentifier{{GroupId: aws.String("sg-00000000000000005"), GroupName: aws.String("default")}},
+			},
+			// The builder using this group might still be
+			// launching.
+			{
+				NetworkInterfaceId: aws.String("eni-00000000000000003"),
+				Groups:             []*ec2.GroupIdentifier{{GroupId: aws.String("sg-44444444444444444"), GroupName: aws.String("packer_4444")}},
+			},
+		},
+	}, true)
+	return nil
+}
+
+func (m *mockEC2ClientLeftovers) DeleteVolume(input *ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error) {
+	m.record(*input.VolumeId)
+	return nil, nil
+}
+
+func (m *mockEC2ClientLeftovers) DeleteSnapshot(input *ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error) {
+	m.record(*input.SnapshotId)
+	return nil, nil
+}
+
+func (m *mockEC2ClientLeftovers) DeleteNetworkInterface(input *ec2.DeleteNetworkInterfaceInput) (*ec2.DeleteNetworkInterfaceOutput, error) {
+	m.record(*input.NetworkInterfaceId)
+	return nil, nil
+}
+
+// This function exercises finding and deleting the volumes, snapshots
+// and network interfaces aborted builds leave behind.
+func TestSweepLeftovers(t *testing.T) {
+	m := &mockEC2ClientLeftovers{}
+	p := testPackerClean(m)
+
+	err := p.SweepLeftovers(context.Background())
+	if err != nil {
+		t.Errorf("ERROR: SweepLeftovers threw error during successful test")
+	}
+
+	marked := []string{"vol-88888888888888882=i-88888888888888888"}
+	if !reflect.DeepEqual(m.marked, marked) {
+		t.Errorf("ERROR: SweepLeftovers marked;\n\texpected: %v\n\tgot: %v", marked, m.marked)
+	}
+
+	expected := []string{
+		"vol-00000000000000001", "vol-00000000000000004", "vol-00000000000000006",
+		"snap-00000000000000001", "snap-00000000000000008", "eni-00000000000000001",
+	}
+	if !reflect.DeepEqual(m.deleted, expected) {
+		t.Errorf("ERROR: SweepLeftovers deleted;\n\texpected: %v\n\tgot: %v", expected, m.deleted)
+	}
+}
+
+// This function makes sure SweepLeftovers stops and says so once we've
+// run out of time.
+func TestSweepLeftoversDeadline(t *testing.T) {
+	m := &mockEC2ClientLeftovers{}
+	p := testPackerClean(m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := p.SweepLeftovers(ctx)
+	if err == nil {
+		t.Errorf("ERROR: SweepLeftovers did not say it ran out of time")
+	}
+	if len(m.deleted) != 0 {
+		t.Errorf("ERROR: SweepLeftovers deleted %v after running out of time", m.deleted)
+	}
+}
+
+// This function makes sure PurgePackerResource copes with builders that
+// have no key pair, one Packer didn't create, and any number of security
+// groups, and only deletes what Packer created.
+func TestPurgePackerResourceShapes(t *testing.T) {
+	packerGroup := &ec2.GroupIdentifier{GroupId: aws.String("sg-55555555555555555"), GroupName: aws.String("packer_5555")}
+	otherPackerGroup := &ec2.GroupIdentifier{GroupId: aws.String("sg-66666666666666666"), GroupName: aws.String("packer_6666")}
+	sharedGroup := &ec2.GroupIdentifier{GroupId: aws.String("sg-77777777777777777"), GroupName: aws.String("build-ssh")}
+
+	tables := []struct {
+		instance *ec2.Instance
+		deleted  []string
+	}{
+		{packerInstanceOld, []string{"packer_1234", "sg-11111111111111111"}},
+		{&ec2.Instance{
+			InstanceId:     aws.String("i-55555555555555555"),
+			SecurityGroups: []*ec2.GroupIdentifier{packerGroup},
+		}, []string{"sg-55555555555555555"}},
+		{&ec2.Instance{
+			InstanceId:     aws.String("i-55555555555555555"),
+			KeyName:        aws.String("deploy"),
+			SecurityGroups: []*ec2.GroupIdentifier{packerGroup, sharedGroup},
+		}, []string{"sg-55555555555555555"}},
+		{&ec2.Instance{
+			InstanceId: aws.String("i-55555555555555555"),
+			KeyName:    aws.String("packer_5555"),
+		}, []string{"packer_5555"}},
+		{&ec2.Instance{
+			InstanceId:     aws.String("i-55555555555555555"),
+			KeyName:        aws.String("packer_5555"),
+			SecurityGroups: []*ec2.GroupIdentifier{packerGroup, otherPackerGroup},
+		}, []string{"packer_5555", "sg-55555555555555555", "sg-66666666666666666"}},
+		{&ec2.Instance{
+			InstanceId:     aws.String("i-55555555555555555"),
+			SecurityGroups: []*ec2.GroupIdentifier{sharedGroup},
+		}, nil},
+	}
+
+	for _, table := range tables {
+		m := &mockEC2Client{}
+		p := testPackerClean(m)
+		err := p.PurgePackerResource(table.instance)
+		if err != nil {
+			t.Errorf("ERROR: PurgePackerResource threw error for %v", table.instance)
+		}
+		if !reflect.DeepEqual(m.deleted, table.deleted) {
+			t.Errorf("ERROR: PurgePackerResource for %v deleted;\n\texpected: %v\n\tgot: %v",
+				table.instance, table.deleted, m.deleted)
+		}
+	}
+}
+
+// This mock EC2Client records the TerminateInstances batches, refuses
+// to terminate any batch with an instance in bad, and never finishes
+// terminating the instances in hang, so we can run out of time waiting
+// for them.
+type mockEC2ClientBatch struct {
+	mockEC2Client
+	batches [][]string
+	bad     map[string]bool
+	hang    map[string]bool
+}
+
+func (m *mockEC2ClientBatch) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, aws.StringValueSlice(input.InstanceIds))
+	for _, id := range input.InstanceIds {
+		if m.bad[*id] {
+			return nil, awserr.New("OperationNotPermitted", "The instance may not be terminated.", nil)
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockEC2ClientBatch) WaitUntilInstanceTerminatedWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.WaiterOption) error {
+	if m.hang[*input.InstanceIds[0]] {
+		<-ctx.Done()
+		return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	return nil
+}
+
+// This function exercises purging a batch of instances in parallel.
+func TestPurgePackerResources(t *testing.T) {
+	m := &mockEC2ClientBatch{}
+	p := testPackerClean(m)
+	p.Workers = 2
+
+	instances := []*ec2.Instance{packerInstanceOld, packerInstanceAncient, packerInstanceStopped}
+	results := p.PurgePackerResources(context.Background(), instances)
+
+	expectedBatches := [][]string{{"i-11111111111111111", "i-22222222222222222", "i-44444444444444444"}}
+	if !reflect.DeepEqual(m.batches, expectedBatches) {
+		t.Errorf("ERROR: PurgePackerResources terminated;\n\texpected: %v\n\tgot: %v", expectedBatches, m.batches)
+	}
+	for _, result := range results {
+		if result.Error != nil || result.Unfinished {
+			t.Errorf("ERROR: PurgePackerResources failed for %v: %v", *result.Instance.InstanceId, result.Error)
+		}
+	}
+
+	// The two older instances share a key pair, so it's deleted twice.
+	expectedDeleted := []string{
+		"packer_1234", "packer_1234", "packer_4321",
+		"sg-11111111111111111", "sg-22222222222222222", "sg-44444444444444444",
+	}
+	sort.Strings(m.deleted)
+	if !reflect.DeepEqual(m.deleted, expectedDeleted) {
+		t.Errorf("ERROR: PurgePackerResources deleted;\n\texpected: %v\n\tgot: %v", expectedDeleted, m.deleted)
+	}
+}
+
+// This function makes sure one instance we can't terminate doesn't stop
+// us from purging the rest of the batch.
+func TestPurgePackerResourcesBadInstance(t *testing.T) {
+	m := &mockEC2ClientBatch{bad: map[string]bool{"i-22222222222222222": true}}
+	p := testPackerClean(m)
+
+	instances := []*ec2.Instance{packerInstanceOld, packerInstanceAncient, packerInstanceStopped}
+	results := p.PurgePackerResources(context.Background(), instances)
+
+	expectedBatches := [][]string{
+		{"i-11111111111111111", "i-22222222222222222", "i-44444444444444444"},
+		{"i-11111111111111111"},
+		{"i-22222222222222222"},
+		{"i-44444444444444444"},
+	}
+	if !reflect.DeepEqual(m.batches, expectedBatches) {
+		t.Errorf("ERROR: PurgePackerResources terminated;\n\texpected: %v\n\tgot: %v", expectedBatches, m.batches)
+	}
+	failed := []bool{false, true, false}
+	for i, result := range results {
+		if (result.Error != nil) != failed[i] || result.Unfinished {
+			t.Errorf("ERROR: PurgePackerResources for %v;\n\texpected failed: %v\n\tgot: %v, unfinished %v",
+				*result.Instance.InstanceId, failed[i], result.Error, result.Unfinished)
+		}
+	}
+
+	expectedDeleted := []string{"packer_1234", "packer_4321", "sg-11111111111111111", "sg-44444444444444444"}
+	sort.Strings(m.deleted)
+	if !reflect.DeepEqual(m.deleted, expectedDeleted) {
+		t.Errorf("ERROR: PurgePackerResources deleted;\n\texpected: %v\n\tgot: %v", expectedDeleted, m.deleted)
+	}
+}
+
+// This function makes sure that when we run out of time, the instances
+// we didn't finish with are reported rather than left hanging.
+func TestPurgePackerResourcesDeadline(t *testing.T) {
+	m := &mockEC2ClientBatch{hang: map[string]bool{"i-22222222222222222": true}}
+	p := testPackerClean(m)
+	p.Workers = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	instances := []*ec2.Instance{packerInstanceOld, packerInstanceAncient, packerInstanceStopped}
+	results := p.PurgePackerResources(ctx, instances)
+
+	unfinished := []bool{false, true, true}
+	for i, result := range results {
+		if result.Unfinished != unfinished[i] {
+			t.Errorf("ERROR: PurgePackerResources for %v;\n\texpected unfinished: %v\n\tgot: %v",
+				*result.Instance.InstanceId, unfinished[i], result.Unfinished)
+		}
+		if result.Unfinished && result.Error == nil {
+			t.Errorf("ERROR: PurgePackerResources did not say why %v is unfinished", *result.Instance.InstanceId)
+		}
+	}
+
+	expectedDeleted := []string{"packer_1234", "sg-11111111111111111"}
+	if !reflect.DeepEqual(m.deleted, expectedDeleted) {
+		t.Errorf("ERROR: PurgePackerResources deleted;\n\texpected: %v\n\tgot: %v", expectedDeleted, m.deleted)
+	}
+}
+
+// This function exercises finding the instances to warn about as well
+// as the ones to purge.
+func TestFindPackerInstances(t *testing.T) {
+	p := testPackerClean(&mockEC2Client{})
+	p.WarningDate = now.Add(time.Hour * -1)
+
+	if class := p.ClassifyInstance(packerInstanceOverdue); class != InstanceClassOverdue {
+		t.Errorf("ERROR: ClassifyInstance for overdue instance;\n\texpected: %v\n\tgot: %v", InstanceClassOverdue, class)
+	}
+	if class := p.ClassifyInstance(packerInstanceNew); class != InstanceClassActive {
+		t.Errorf("ERROR: ClassifyInstance for new instance;\n\texpected: %v\n\tgot: %v", InstanceClassActive, class)
+	}
+
+	// Instances past the expiration date that we've warned about are
+	// abandoned, but the ones we haven't warned about yet are overdue.
+	expired := &ec2.Instance{
+		Tags:       []*ec2.Tag{{Key: aws.String(WarnedTag), Value: aws.String("2019-06-30T01:00:00Z")}},
+		LaunchTime: packerInstanceOld.LaunchTime,
+		InstanceId: aws.String("i-88888888888888888"),
+		State:      &ec2.InstanceState{Name: aws.String("running")},
+	}
+	if class := p.ClassifyInstance(expired); class != InstanceClassAbandoned {
+		t.Errorf("ERROR: ClassifyInstance for warned expired instance;\n\texpected: %v\n\tgot: %v", InstanceClassAbandoned, class)
+	}
+	if class := p.ClassifyInstance(packerInstanceOld); class != InstanceClassOverdue {
+		t.Errorf("ERROR: ClassifyInstance for unwarned expired instance;\n\texpected: %v\n\tgot: %v", InstanceClassOverdue, class)
+	}
+
+	purgeSet, warnSet, err := p.FindPackerInstances()
+	if err != nil {
+		t.Errorf("ERROR: FindPackerInstances threw error during successful test")
+	}
+
+	if len(purgeSet) != 0 {
+		t.Errorf("ERROR: FindPackerInstances to purge;\n\texpected: none,\n\tgot: %v", purgeSet)
+	}
+	expectedWarn := []*ec2.Instance{packerInstanceOld, packerInstanceAncient, packerInstanceStopped, packerInstanceOverdue}
+	if !sliceEqual(warnSet, expectedWarn) {
+		t.Errorf("ERROR: FindPackerInstances to warn about;\n\texpected: %v,\n\tgot: %v", expectedWarn, warnSet)
+	}
+}
+
+// This function makes sure an instance past the UnwarnedDate is
+// abandoned even though we never managed to mark it as warned about.
+func TestClassifyInstanceUnwarned(t *testing.T) {
+	p := testPackerClean(&mockEC2Client{})
+	p.WarningDate = now.Add(time.Hour * -1)
+	p.UnwarnedDate = now.Add(time.Hour * -8)
+
+	recent := &ec2.Instance{
+		LaunchTime: aws.Time(now.Add(time.Hour * -6)),
+		InstanceId: aws.String("i-88888888888888888"),
+		State:      &ec2.InstanceState{Name: aws.String("running")},
+	}
+
+	tables := []struct {
+		instance *ec2.Instance
+		class    InstanceClass
+	}{
+		{recent, InstanceClassOverdue},
+		{packerInstanceOld, InstanceClassAbandoned},
+		{packerInstanceStopped, InstanceClassStopped},
+		{packerInstanceOverdue, InstanceClassOverdue},
+		{packerInstanceKept, InstanceClassKept},
+	}
+	for _, table := range tables {
+		class := p.ClassifyInstance(table.instance)
+		if class != table.class {
+			t.Errorf("ERROR: ClassifyInstance for %v;\n\texpected: %v\n\tgot: %v",
+				*table.instance.InstanceId, table.class, class)
+		}
+	}
+}
+
+// This function makes sure a dry run reports the instances past the
+// expiration date that a real run would terminate once it had warned
+// about them, since a dry run never marks them as warned.
+func TestFindPackerInstancesDryRun(t *testing.T) {
+	p := testPackerClean(&mockEC2Client{})
+	p.Delete = false
+	p.WarningDate = now.Add(time.Hour * -1)
+
+	purgeSet, warnSet, err := p.FindPackerInstances()
+	if err != nil {
+		t.Errorf("ERROR: FindPackerInstances threw error during successful test")
+	}
+
+	expectedPurge := []*ec2.Instance{packerInstanceOld, packerInstanceAncient, packerInstanceStopped}
+	if !sliceEqual(purgeSet, expectedPurge) {
+		t.Errorf("ERROR: FindPackerInstances to purge;\n\texpected: %v,\n\tgot: %v", expectedPurge, purgeSet)
+	}
+	expectedWarn := []*ec2.Instance{packerInstanceOld, packerInstanceAncient, packerInstanceStopped, packerInstanceOverdue}
+	if !sliceEqual(warnSet, expectedWarn) {
+		t.Errorf("ERROR: FindPackerInstances to warn about;\n\texpected: %v,\n\tgot: %v", expectedWarn, warnSet)
+	}
+}
+
+// This function makes sure we mark instances as warned about even when
+// the warning fails, so that they don't stay overdue for good.
+func TestWarnOwnersWarningFails(t *testing.T) {
+	m := &mockEC2Client{}
+	p := testPackerClean(m)
+	p.Now = now
+
+	instances := []*ec2.Instance{packerInstanceOld, packerInstanceOverdue}
+	err := p.WarnOwners(instances, func([]*ec2.Instance) error {
+		return errors.New("slack is down")
+	})
+	if err == nil {
+		t.Errorf("ERROR: WarnOwners did not return the error from the warning")
+	}
+
+	expected := []string{"i-11111111111111111=" + WarnedTag, "i-55555555555555555=" + WarnedTag}
+	if !reflect.DeepEqual(m.tagged, expected) {
+		t.Errorf("ERROR: WarnOwners marked;\n\texpected: %v\n\tgot: %v", expected, m.tagged)
+	}
+}
+
+// This function makes sure a dry run neither warns anyone nor marks
+// anything.
+func TestWarnOwnersDryRun(t *testing.T) {
+	m := &mockEC2Client{}
+	p := testPackerClean(m)
+	p.Delete = false
+
+	warned := false
+	err := p.WarnOwners([]*ec2.Instance{packerInstanceOverdue}, func([]*ec2.Instance) error {
+		warned = true
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ERROR: WarnOwners threw error during dry run")
+	}
+	if warned || len(m.tagged) != 0 {
+		t.Errorf("ERROR: WarnOwners warned %v and marked %v during dry run", warned, m.tagged)
+	}
+}
+
+func TestInstanceOwner(t *testing.T) {
+	tables := []struct {
+		instance *ec2.Instance
+		owner    string
+	}{
+		{packerInstanceOld, ""},
+		{packerInstanceOverdue, "builder@example.com"},
+		{packerInstanceKept, "debugger"},
+		{&ec2.Instance{Tags: []*ec2.Tag{
+			{Key: aws.String("CreatedBy"), Value: aws.String("ci")},
+			{Key: aws.String("Owner"), Value: aws.String("platform")},
+		}}, "platform"},
+	}
+
+	for _, table := range tables {
+		owner := InstanceOwner(table.instance)
+		if owner != table.owner {
+			t.Errorf("ERROR: InstanceOwner for %v;\n\texpected: %q\n\tgot: %q", table.instance.Tags, table.owner, owner)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package rdsclean
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"go.uber.org/zap"
+)
+
+// RDSManualClusterSnapshotClean defines parameters for cleaning manual
+// Aurora DB cluster snapshots based on ExpirationDate and
+// MaxDBSnapshotCount, or on Policy if it's set. Aurora keeps its
+// snapshots per cluster rather than per instance, so this is the cluster
+// counterpart of RDSManualSnapshotClean, and protects the same cluster
+// snapshots: the ones with one of the KeepTags, shared with other
+// accounts, or being copied.
+type RDSManualClusterSnapshotClean struct {
+	DBClusterIdentifier    string
+	DryRun                 bool
+	ExpirationDate         time.Time
+	Logger                 *zap.Logger
+	MaxDBSnapshotCount     uint
+	Policy                 GFSPolicy
+	Now                    time.Time
+	KeepTags               []*rds.Tag
+	CopyDestinationClients []rdsiface.RDSAPI
+	RDSClient              rdsiface.RDSAPI
+}
+
+// FindDBClusterSnapshotsToDelete will return a slice of DB cluster
+// snapshots to delete. As with FindDBSnapshotsToDelete, a retention
+// policy takes the place of ExpirationDate and MaxDBSnapshotCount.
+func (r *RDSManualClusterSnapshotClean) FindDBClusterSnapshotsToDelete(dbClusterSnapshots []*rds.DBClusterSnapshot) ([]*rds.DBClusterSnapshot, error) {
+	var dbClusterSnapshotsToDelete []*rds.DBClusterSnapshot
+
+	sortDBClusterSnapshots(dbClusterSnapshots)
+	if !r.Policy.IsEmpty() {
+		kept := r.Policy.KeepDBClusterSnapshots(r.Now, dbClusterSnapshots)
+		for _, s := range dbClusterSnapshots {
+			if reason, ok := kept[*s.DBClusterSnapshotIdentifier]; ok {
+				r.Logger.Info("keeping db cluster snapshot under retention policy",
+					zap.String("db-cluster-snapshot-identifier", *s.DBClusterSnapshotIdentifier),
+					zap.String("retention-reason", reason),
+				)
+				continue
+			}
+			dbClusterSnapshotsToDelete = append(dbClusterSnapshotsToDelete, s)
+		}
+		return dbClusterSnapshotsToDelete, nil
+	}
+
+	for i, s := range dbClusterSnapshots {
+		// add snapshot to delete slice if past expiration
+		if s.SnapshotCreateTime.Before(r.ExpirationDate) {
+			dbClusterSnapshotsToDelete = append(dbClusterSnapshotsToDelete, s)
+			continue
+		}
+		// if we are still over maxDBSnapshots add to the delete slice
+		// skip if maxDBSnapshotsCount is 0
+		if i+1 > int(r.MaxDBSnapshotCount) && r.MaxDBSnapshotCount != 0 {
+			dbClusterSnapshotsToDelete = append(dbClusterSnapshotsToDelete, s)
+		}
+	}
+
+	return dbClusterSnapshotsToDelete, nil
+}
+
+// ManualDBClusterSnapshots are the manual snapshots of a cluster, split
+// up the same way as ManualDBSnapshots.
+type ManualDBClusterSnapshots struct {
+	Available   []*rds.DBClusterSnapshot
+	Unavailable map[string][]*rds.DBClusterSnapshot
+	Protected   map[string][]*rds.DBClusterSnapshot
+}
+
+// UnavailableIdentifiers lists the identifiers of the cluster snapshots
+// that aren't available, keyed by their status.
+func (m *ManualDBClusterSnapshots) UnavailableIdentifiers() map[string][]string {
+	identifiers := map[string][]string{}
+	for status, dbClusterSnapshots := range m.Unavailable {
+		for _, s := range dbClusterSnapshots {
+			identifiers[status] = append(identifiers[status], aws.StringValue(s.DBClusterSnapshotIdentifier))
+		}
+	}
+	return identifiers
+}
+
+// ProtectedIdentifiers lists the identifiers of the cluster snapshots we
+// protect, keyed by the reason.
+func (m *ManualDBClusterSnapshots) ProtectedIdentifiers() map[string][]string {
+	identifiers := map[string][]string{}
+	for reason, dbClusterSnapshots := range m.Protected {
+		for _, s := range dbClusterSnapshots {
+			identifiers[reason] = append(identifiers[reason], aws.StringValue(s.DBClusterSnapshotIdentifier))
+		}
+	}
+	return identifiers
+}
+
+// ListManualDBClusterSnapshots pages through the manual snapshots of the
+// cluster, sorts them by status, and sets aside the ones we protect.
+func (r *RDSManualClusterSnapshotClean) ListManualDBClusterSnapshots() (*ManualDBClusterSnapshots, error) {
+	manualDBClusterSnapshots := &ManualDBClusterSnapshots{
+		Unavailable: map[string][]*rds.DBClusterSnapshot{},
+		Protected:   map[string][]*rds.DBClusterSnapshot{},
+	}
+
+	input := &rds.DescribeDBClusterSnapshotsInput{
+		DBClusterIdentifier: aws.String(r.DBClusterIdentifier),
+		IncludePublic:       aws.Bool(false),
+		IncludeShared:       aws.Bool(false),
+		SnapshotType:        aws.String("manual"),
+	}
+
+	err := r.RDSClient.DescribeDBClusterSnapshotsPages(input,
+		func(page *rds.DescribeDBClusterSnapshotsOutput, lastPage bool) bool {
+			for _, s := range page.DBClusterSnapshots {
+				status := aws.StringValue(s.Status)
+				if status == DBSnapshotStatusAvailable && s.SnapshotCreateTime != nil {
+					manualDBClusterSnapshots.Available = append(manualDBClusterSnapshots.Available, s)
+					continue
+				}
+				manualDBClusterSnapshots.Unavailable[status] = append(manualDBClusterSnapshots.Unavailable[status], s)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.protectDBClusterSnapshots(manualDBClusterSnapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	return manualDBClusterSnapshots, nil
+}
+
+// FindManualDBClusterSnapshots returns a slice of available manual
+// cluster snapshots that aren't protected
+func (r *RDSManualClusterSnapshotClean) FindManualDBClusterSnapshots() ([]*rds.DBClusterSnapshot, error) {
+	manualDBClusterSnapshots, err := r.ListManualDBClusterSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	return manualDBClusterSnapshots.Available, nil
+}
+
+// sortDBClusterSnapshots sorts a slice of DB cluster snapshots in
+// chronological order(newest first) using SnapshotCreateTime
+func sortDBClusterSnapshots(dbClusterSnapshots []*rds.DBClusterSnapshot) {
+	sort.Slice(dbClusterSnapshots, func(i, j int) bool {
+		return dbClusterSnapshots[i].SnapshotCreateTime.After(*dbClusterSnapshots[j].SnapshotCreateTime)
+	})
+}
+
+// DeleteDBClusterSnapshots iterates through a list of cluster snapshots
+// and calls DeleteDBClusterSnapshot
+func (r *RDSManualClusterSnapshotClean) DeleteDBClusterSnapshots(dbClusterSnapshotsToDelete []*rds.DBClusterSnapshot) error {
+	r.Logger.Info("db cluster snapshots to delete", zap.Int("snapshots", len(dbClusterSnapshotsToDelete)))
+	for _, e := range dbClusterSnapshotsToDelete {
+		if r.DryRun {
+			r.Logger.Info("would delete db cluster snapshot",
+				zap.String("db-cluster-snapshot-identifier", *e.DBClusterSnapshotIdentifier),
+				zap.String("db-cluster-snapshot-create-time", e.SnapshotCreateTime.Format(RFC8601)),
+			)
+
+		} else {
+			r.Logger.Info("deleting cluster snapshot",
+				zap.String("db-cluster-snapshot-identifier", *e.DBClusterSnapshotIdentifier),
+				zap.String("db-cluster-snapshot-create-time", e.SnapshotCreateTime.Format(RFC8601)),
+			)
+			err := r.DeleteDBClusterSnapshot(*e.DBClusterSnapshotIdentifier)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteDBClusterSnapshot deletes DB cluster snapshot and waits for it to
+// complete
+func (r *RDSManualClusterSnapshotClean) DeleteDBClusterSnapshot(DBClusterSnapshotIdentifier string) error {
+	deleteDBClusterSnapshotInput := &rds.DeleteDBClusterSnapshotInput{
+		DBClusterSnapshotIdentifier: aws.String(DBClusterSnapshotIdentifier),
+	}
+	_, err := r.RDSClient.DeleteDBClusterSnapshot(deleteDBClusterSnapshotInput)
+	if err != nil {
+		return err
+	}
+
+	waitUntilDBClusterSnapshotDeletedInput := &rds.DescribeDBClusterSnapshotsInput{
+		DBClusterSnapshotIdentifier: aws.String(DBClusterSnapshotIdentifier),
+	}
+	err = r.RDSClient.WaitUntilDBClusterSnapshotDeleted(waitUntilDBClusterSnapshotDeletedInput)
+	return err
+}
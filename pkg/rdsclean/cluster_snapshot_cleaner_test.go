@@ -0,0 +1,265 @@
+package rdsclean
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"go.uber.org/zap"
+)
+
+var oldDBClusterSnapshot = &rds.DBClusterSnapshot{
+	DBClusterIdentifier:         aws.String("foo-cluster"),
+	DBClusterSnapshotIdentifier: aws.String("old-cluster-snapshot"),
+	SnapshotCreateTime:          aws.Time(getTime("2017-03-01T22:00:00+00:00")),
+	Status:                      aws.String("available"),
+}
+
+var newDBClusterSnapshot = &rds.DBClusterSnapshot{
+	DBClusterIdentifier:         aws.String("foo-cluster"),
+	DBClusterSnapshotIdentifier: aws.String("new-cluster-snapshot"),
+	SnapshotCreateTime:          aws.Time(getTime("2017-03-03T22:00:00+00:00")),
+	Status:                      aws.String("available"),
+}
+
+var creatingDBClusterSnapshot = &rds.DBClusterSnapshot{
+	DBClusterIdentifier:         aws.String("foo-cluster"),
+	DBClusterSnapshotIdentifier: aws.String("creating-cluster-snapshot"),
+	SnapshotCreateTime:          aws.Time(getTime("2017-03-04T22:00:00+00:00")),
+	Status:                      aws.String("creating"),
+}
+
+// mockRDSClientClusters serves Aurora clusters and their snapshots one
+// per page, and says the snapshots in shared are shared with another
+// account.
+type mockRDSClientClusters struct {
+	mockRDSClient
+	clusters  []*rds.DBCluster
+	snapshots []*rds.DBClusterSnapshot
+	shared    map[string]bool
+}
+
+func (m *mockRDSClientClusters) DescribeDBClusterSnapshotAttributes(input *rds.DescribeDBClusterSnapshotAttributesInput) (*rds.DescribeDBClusterSnapshotAttributesOutput, error) {
+	attribute := &rds.DBClusterSnapshotAttribute{AttributeName: aws.String("restore")}
+	if m.shared[aws.StringValue(input.DBClusterSnapshotIdentifier)] {
+		attribute.AttributeValues = []*string{aws.String("123456789012")}
+	}
+	return &rds.DescribeDBClusterSnapshotAttributesOutput{
+		DBClusterSnapshotAttributesResult: &rds.DBClusterSnapshotAttributesResult{
+			DBClusterSnapshotIdentifier: input.DBClusterSnapshotIdentifier,
+			DBClusterSnapshotAttributes: []*rds.DBClusterSnapshotAttribute{attribute},
+		},
+	}, nil
+}
+
+func (m *mockRDSClientClusters) DescribeDBClustersPages(input *rds.DescribeDBClustersInput, fn func(*rds.DescribeDBClustersOutput, bool) bool) error {
+	for i, cluster := range m.clusters {
+		page := &rds.DescribeDBClustersOutput{DBClusters: []*rds.DBCluster{cluster}}
+		if !fn(page, i == len(m.clusters)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockRDSClientClusters) DescribeDBClusterSnapshotsPages(input *rds.DescribeDBClusterSnapshotsInput, fn func(*rds.DescribeDBClusterSnapshotsOutput, bool) bool) error {
+	for i, snapshot := range m.snapshots {
+		if aws.StringValue(snapshot.DBClusterIdentifier) != aws.StringValue(input.DBClusterIdentifier) {
+			continue
+		}
+		page := &rds.DescribeDBClusterSnapshotsOutput{DBClusterSnapshots: []*rds.DBClusterSnapshot{snapshot}}
+		if !fn(page, i == len(m.snapshots)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestSelectDBClusters(t *testing.T) {
+	client := &mockRDSClientClusters{
+		clusters: []*rds.DBCluster{
+			{DBClusterIdentifier: aws.String("foo-cluster")},
+			{
+				DBClusterIdentifier: aws.String("bar-cluster"),
+				TagList:             []*rds.Tag{{Key: aws.String("SnapshotRetention"), Value: aws.String("7")}},
+			},
+		},
+	}
+	tests := []struct {
+		selector InstanceSelector
+		want     []string
+	}{
+		{InstanceSelector{IdentifierPatterns: []string{"foo-*"}}, []string{"foo-cluster"}},
+		{InstanceSelector{Tags: []*rds.Tag{{Key: aws.String("SnapshotRetention"), Value: aws.String("")}}}, []string{"bar-cluster"}},
+		{InstanceSelector{All: true}, []string{"foo-cluster", "bar-cluster"}},
+	}
+	for _, test := range tests {
+		clusters, err := SelectDBClusters(client, test.selector)
+		if err != nil {
+			t.Errorf("ERROR: SelectDBClusters(%+v) error = %v", test.selector, err)
+			continue
+		}
+		var got []string
+		for _, cluster := range clusters {
+			got = append(got, aws.StringValue(cluster.DBClusterIdentifier))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ERROR: SelectDBClusters(%+v) = %v, want %v", test.selector, got, test.want)
+		}
+	}
+}
+
+func TestFindManualDBClusterSnapshots(t *testing.T) {
+	client := &mockRDSClientClusters{
+		snapshots: []*rds.DBClusterSnapshot{
+			oldDBClusterSnapshot,
+			creatingDBClusterSnapshot,
+			{DBClusterIdentifier: aws.String("bar-cluster"), DBClusterSnapshotIdentifier: aws.String("bar-snapshot")},
+			newDBClusterSnapshot,
+		},
+	}
+	logger, _ := zap.NewProduction()
+	r := RDSManualClusterSnapshotClean{
+		DBClusterIdentifier: "foo-cluster",
+		DryRun:              true,
+		Logger:              logger,
+		RDSClient:           client,
+	}
+
+	want := []*rds.DBClusterSnapshot{oldDBClusterSnapshot, newDBClusterSnapshot}
+	got, err := r.FindManualDBClusterSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: FindManualDBClusterSnapshots() = %v, want %v", got, want)
+	}
+}
+
+func TestListManualDBClusterSnapshotsShared(t *testing.T) {
+	client := &mockRDSClientClusters{
+		snapshots: []*rds.DBClusterSnapshot{oldDBClusterSnapshot, newDBClusterSnapshot},
+		shared:    map[string]bool{"old-cluster-snapshot": true},
+	}
+	logger, _ := zap.NewProduction()
+	r := RDSManualClusterSnapshotClean{
+		DBClusterIdentifier: "foo-cluster",
+		DryRun:              true,
+		Logger:              logger,
+		RDSClient:           client,
+	}
+
+	got, err := r.ListManualDBClusterSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*rds.DBClusterSnapshot{newDBClusterSnapshot}; !reflect.DeepEqual(got.Available, want) {
+		t.Errorf("ERROR: ListManualDBClusterSnapshots() available = %v, want %v", got.Available, want)
+	}
+	want := map[string][]string{ProtectedShared: {"old-cluster-snapshot"}}
+	if protected := got.ProtectedIdentifiers(); !reflect.DeepEqual(protected, want) {
+		t.Errorf("ERROR: ListManualDBClusterSnapshots() protected = %v, want %v", protected, want)
+	}
+}
+
+func TestListManualDBClusterSnapshotsProtected(t *testing.T) {
+	snapshot := func(id, status, created string) *rds.DBClusterSnapshot {
+		return &rds.DBClusterSnapshot{
+			DBClusterIdentifier:         aws.String("foo-cluster"),
+			DBClusterSnapshotIdentifier: aws.String(id),
+			DBClusterSnapshotArn:        aws.String("arn:aws:rds:us-west-2:123456789012:cluster-snapshot:" + id),
+			SnapshotCreateTime:          aws.Time(getTime(created)),
+			Status:                      aws.String(status),
+			PercentProgress:             aws.Int64(100),
+		}
+	}
+	held := snapshot("held", "available", "2017-03-01T01:00:00+00:00")
+	held.TagList = []*rds.Tag{{Key: aws.String("Retain"), Value: aws.String("true")}}
+	notHeld := snapshot("not-held", "available", "2017-03-01T02:00:00+00:00")
+	notHeld.TagList = []*rds.Tag{{Key: aws.String("Retain"), Value: aws.String("false")}}
+	shared := snapshot("shared", "available", "2017-03-01T03:00:00+00:00")
+	copiedHere := snapshot("copied-here", "available", "2017-03-01T04:00:00+00:00")
+	copiedAway := snapshot("copied-away", "available", "2017-03-01T05:00:00+00:00")
+	copiedBefore := snapshot("copied-before", "available", "2017-03-01T06:00:00+00:00")
+	failedCopySource := snapshot("failed-copy-source", "available", "2017-03-01T07:00:00+00:00")
+	plain := snapshot("plain", "available", "2017-03-02T01:00:00+00:00")
+
+	copyHere := snapshot("copy-here", "copying", "2017-03-03T01:00:00+00:00")
+	copyHere.SourceDBClusterSnapshotArn = copiedHere.DBClusterSnapshotArn
+	copyHere.PercentProgress = aws.Int64(40)
+	failedCopy := snapshot("failed-copy", "failed", "2017-03-03T02:00:00+00:00")
+	failedCopy.SourceDBClusterSnapshotArn = failedCopySource.DBClusterSnapshotArn
+
+	// RDS can call a copy available before it's all there, so we go by
+	// how far along it is too.
+	copyAway := snapshot("copy-away", "available", "2017-03-03T03:00:00+00:00")
+	copyAway.SourceDBClusterSnapshotArn = copiedAway.DBClusterSnapshotArn
+	copyAway.PercentProgress = aws.Int64(90)
+	copyDone := snapshot("copy-done", "available", "2017-03-03T04:00:00+00:00")
+	copyDone.SourceDBClusterSnapshotArn = copiedBefore.DBClusterSnapshotArn
+
+	logger, _ := zap.NewProduction()
+	r := RDSManualClusterSnapshotClean{
+		DBClusterIdentifier: "foo-cluster",
+		Logger:              logger,
+		KeepTags:            []*rds.Tag{{Key: aws.String("Retain"), Value: aws.String("true")}},
+		CopyDestinationClients: []rdsiface.RDSAPI{
+			&mockRDSClientClusters{snapshots: []*rds.DBClusterSnapshot{copyAway, copyDone}},
+		},
+		RDSClient: &mockRDSClientClusters{
+			snapshots: []*rds.DBClusterSnapshot{
+				held, notHeld, shared, copiedHere, copiedAway, copiedBefore,
+				failedCopySource, plain, copyHere, failedCopy,
+			},
+			shared: map[string]bool{"shared": true},
+		},
+	}
+
+	got, err := r.ListManualDBClusterSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantProtected := map[string][]string{
+		ProtectedKeepTag:    {"held"},
+		ProtectedShared:     {"shared"},
+		ProtectedCopySource: {"copied-here", "copied-away"},
+	}
+	if haveProtected := got.ProtectedIdentifiers(); !reflect.DeepEqual(haveProtected, wantProtected) {
+		t.Errorf("ERROR: ListManualDBClusterSnapshots().ProtectedIdentifiers() = %v, want %v", haveProtected, wantProtected)
+	}
+	wantAvailable := []*rds.DBClusterSnapshot{notHeld, copiedBefore, failedCopySource, plain}
+	if !reflect.DeepEqual(got.Available, wantAvailable) {
+		t.Errorf("ERROR: ListManualDBClusterSnapshots().Available = %v, want %v", got.Available, wantAvailable)
+	}
+}
+
+func TestFindDBClusterSnapshotsToDelete(t *testing.T) {
+	tests := []struct {
+		name           string
+		expirationDate string
+		maxCount       uint
+		want           []*rds.DBClusterSnapshot
+	}{
+		{"expired", "2017-03-02T22:00:00+00:00", 0, []*rds.DBClusterSnapshot{oldDBClusterSnapshot}},
+		{"over max count", "2017-02-28T22:00:00+00:00", 2, []*rds.DBClusterSnapshot{oldDBClusterSnapshot}},
+		{"nothing to delete", "2017-02-28T22:00:00+00:00", 0, nil},
+	}
+	for _, test := range tests {
+		r := RDSManualClusterSnapshotClean{
+			DBClusterIdentifier: "foo-cluster",
+			ExpirationDate:      getTime(test.expirationDate),
+			MaxDBSnapshotCount:  test.maxCount,
+		}
+		snapshots := []*rds.DBClusterSnapshot{oldDBClusterSnapshot, newDBClusterSnapshot, newDBClusterSnapshot}
+		got, err := r.FindDBClusterSnapshotsToDelete(snapshots)
+		if err != nil {
+			t.Errorf("ERROR: %s: FindDBClusterSnapshotsToDelete() error = %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ERROR: %s: FindDBClusterSnapshotsToDelete() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package rdsclean
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// GFSPolicy is a grandfather-father-son retention policy. For each of the
+// last Daily days, Weekly weeks, Monthly months and Yearly years,
+// counting the current one, it keeps the first snapshot taken in that
+// day, week, month or year. Keeping the first rather than the newest
+// means a snapshot, once kept for a period, stays kept until the period
+// falls out of the window, however many more are taken in it. Snapshots
+// taken after the newest one it keeps are kept too, until a newer one is
+// kept in their place, so that a snapshot someone has just taken by hand
+// isn't deleted because the day already had one. Periods are calendar
+// periods in UTC, and weeks start on Monday.
+//
+// The policy only looks at creation times, so it can be used for any
+// kind of snapshot; see Keep.
+type GFSPolicy struct {
+	Daily   uint `json:"daily"`
+	Weekly  uint `json:"weekly"`
+	Monthly uint `json:"monthly"`
+	Yearly  uint `json:"yearly"`
+}
+
+// The reasons Keep gives for keeping a snapshot.
+const (
+	GFSDaily   = "daily"
+	GFSWeekly  = "weekly"
+	GFSMonthly = "monthly"
+	GFSYearly  = "yearly"
+	// GFSRecent is for snapshots newer than the newest one kept for
+	// any other reason.
+	GFSRecent = "recent"
+)
+
+// gfsTier is one level of the policy: how many periods to keep, and how
+// to number the period a time falls in, so that consecutive periods get
+// consecutive numbers.
+type gfsTier struct {
+	reason string
+	count  uint
+	period func(time.Time) int
+}
+
+// gfsDay numbers days since the Unix epoch.
+func gfsDay(t time.Time) int {
+	t = t.UTC()
+	return int(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+}
+
+// gfsWeek numbers weeks starting on Monday. The epoch was a Thursday, so
+// we shift by three days to line the weeks up with Mondays.
+func gfsWeek(t time.Time) int {
+	return (gfsDay(t) + 3) / 7
+}
+
+// gfsMonth numbers months since the year 0.
+func gfsMonth(t time.Time) int {
+	t = t.UTC()
+	return t.Year()*12 + int(t.Month()) - 1
+}
+
+// gfsYear numbers years.
+func gfsYear(t time.Time) int {
+	return t.UTC().Year()
+}
+
+// IsEmpty reports whether the policy keeps nothing at all, which we take
+// to mean there's no policy.
+func (p GFSPolicy) IsEmpty() bool {
+	return p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0 && p.Yearly == 0
+}
+
+// tiers returns the levels of the policy, finest first.
+func (p GFSPolicy) tiers() []gfsTier {
+	return []gfsTier{
+		{GFSDaily, p.Daily, gfsDay},
+		{GFSWeekly, p.Weekly, gfsWeek},
+		{GFSMonthly, p.Monthly, gfsMonth},
+		{GFSYearly, p.Yearly, gfsYear},
+	}
+}
+
+// Keep works out which of a set of snapshots, given by their creation
+// times, the policy keeps as of now. It returns the reason each one is
+// kept, in the same order as created, or "" for the ones it doesn't keep.
+// A snapshot kept for more than one reason gets the finest one.
+func (p GFSPolicy) Keep(now time.Time, created []time.Time) []string {
+	reasons := make([]string, len(created))
+
+	// Go through the snapshots oldest first, so that the first one we
+	// see in each period is the one we keep.
+	order := make([]int, len(created))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return created[order[i]].Before(created[order[j]])
+	})
+
+	for _, tier := range p.tiers() {
+		if tier.count == 0 {
+			continue
+		}
+		current := tier.period(now)
+		seen := map[int]bool{}
+		for _, i := range order {
+			period := tier.period(created[i])
+			if current-period >= int(tier.count) || seen[period] {
+				continue
+			}
+			seen[period] = true
+			if reasons[i] == "" {
+				reasons[i] = tier.reason
+			}
+		}
+	}
+
+	// Nothing newer than the newest snapshot we keep has been
+	// superseded yet.
+	var newest time.Time
+	for i, reason := range reasons {
+		if reason != "" && created[i].After(newest) {
+			newest = created[i]
+		}
+	}
+	for i := range created {
+		if reasons[i] == "" && !newest.IsZero() && created[i].After(newest) {
+			reasons[i] = GFSRecent
+		}
+	}
+
+	return reasons
+}
+
+// KeepDBSnapshots returns the reason the policy keeps each of the given
+// DB snapshots, keyed by snapshot identifier. Snapshots it doesn't keep
+// are left out.
+func (p GFSPolicy) KeepDBSnapshots(now time.Time, dbSnapshots []*rds.DBSnapshot) map[string]string {
+	created := make([]time.Time, len(dbSnapshots))
+	for i, s := range dbSnapshots {
+		created[i] = aws.TimeValue(s.SnapshotCreateTime)
+	}
+
+	kept := map[string]string{}
+	for i, reason := range p.Keep(now, created) {
+		if reason != "" {
+			kept[aws.StringValue(dbSnapshots[i].DBSnapshotIdentifier)] = reason
+		}
+	}
+	return kept
+}
+
+// KeepDBClusterSnapshots is KeepDBSnapshots for Aurora cluster
+// snapshots.
+func (p GFSPolicy) KeepDBClusterSnapshots(now time.Time, dbClusterSnapshots []*rds.DBClusterSnapshot) map[string]string {
+	created := make([]time.Time, len(dbClusterSnapshots))
+	for i, s := range dbClusterSnapshots {
+		created[i] = aws.TimeValue(s.SnapshotCreateTime)
+	}
+
+	kept := map[string]string{}
+	for i, reason := range p.Keep(now, created) {
+		if reason != "" {
+			kept[aws.StringValue(dbClusterSnapshots[i].DBClusterSnapshotIdentifier)] = reason
+		}
+	}
+	return kept
+}
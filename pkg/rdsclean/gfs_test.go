@@ -0,0 +1,187 @@
+package rdsclean
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"go.uber.org/zap"
+)
+
+// dailyDBSnapshots makes a snapshot at noon every day for days days,
+// ending on the day of now, oldest first.
+func dailyDBSnapshots(now time.Time, days int) []*rds.DBSnapshot {
+	var snapshots []*rds.DBSnapshot
+	end := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, time.UTC)
+	for i := days - 1; i >= 0; i-- {
+		created := end.AddDate(0, 0, -i)
+		snapshots = append(snapshots, &rds.DBSnapshot{
+			DBSnapshotIdentifier: aws.String(created.Format("snap-2006-01-02")),
+			SnapshotCreateTime:   aws.Time(created),
+			Status:               aws.String("available"),
+		})
+	}
+	return snapshots
+}
+
+func TestGFSPolicyKeep(t *testing.T) {
+	// A Wednesday.
+	now := getTime("2019-07-17T18:00:00+00:00")
+	at := func(s string) time.Time { return getTime(s) }
+	tests := []struct {
+		name    string
+		policy  GFSPolicy
+		created []time.Time
+		want    []string
+	}{
+		{
+			name:   "first of each day",
+			policy: GFSPolicy{Daily: 2},
+			created: []time.Time{
+				at("2019-07-17T01:00:00+00:00"),
+				at("2019-07-16T23:00:00+00:00"),
+				at("2019-07-16T01:00:00+00:00"),
+				at("2019-07-15T01:00:00+00:00"),
+			},
+			want: []string{GFSDaily, "", GFSDaily, ""},
+		},
+		{
+			name:   "two today",
+			policy: GFSPolicy{Daily: 2},
+			created: []time.Time{
+				at("2019-07-17T13:00:00+00:00"),
+				at("2019-07-17T01:00:00+00:00"),
+				at("2019-07-16T01:00:00+00:00"),
+			},
+			want: []string{GFSRecent, GFSDaily, GFSDaily},
+		},
+		{
+			name:   "two yesterday and none today",
+			policy: GFSPolicy{Daily: 2},
+			created: []time.Time{
+				at("2019-07-16T23:00:00+00:00"),
+				at("2019-07-16T01:00:00+00:00"),
+			},
+			want: []string{GFSRecent, GFSDaily},
+		},
+		{
+			name:   "weeks start on monday",
+			policy: GFSPolicy{Weekly: 2},
+			created: []time.Time{
+				at("2019-07-15T01:00:00+00:00"), // Monday this week
+				at("2019-07-14T01:00:00+00:00"), // Sunday last week
+				at("2019-07-08T01:00:00+00:00"), // Monday last week
+				at("2019-07-07T01:00:00+00:00"), // Sunday the week before
+			},
+			want: []string{GFSWeekly, "", GFSWeekly, ""},
+		},
+		{
+			name:   "months and years",
+			policy: GFSPolicy{Monthly: 2, Yearly: 3},
+			created: []time.Time{
+				at("2019-07-02T01:00:00+00:00"),
+				at("2019-06-30T01:00:00+00:00"),
+				at("2019-05-01T01:00:00+00:00"),
+				at("2019-01-01T01:00:00+00:00"),
+				at("2018-12-31T01:00:00+00:00"),
+				at("2017-03-01T01:00:00+00:00"),
+				at("2016-12-31T01:00:00+00:00"),
+			},
+			want: []string{GFSMonthly, GFSMonthly, "", GFSYearly, GFSYearly, GFSYearly, ""},
+		},
+		{
+			name:   "finest reason wins",
+			policy: GFSPolicy{Daily: 1, Weekly: 1, Monthly: 1, Yearly: 1},
+			created: []time.Time{
+				at("2019-07-17T01:00:00+00:00"),
+				at("2019-07-15T01:00:00+00:00"),
+				at("2019-07-01T01:00:00+00:00"),
+				at("2019-01-01T01:00:00+00:00"),
+			},
+			want: []string{GFSDaily, GFSWeekly, GFSMonthly, GFSYearly},
+		},
+		{
+			name:    "nothing",
+			policy:  GFSPolicy{},
+			created: []time.Time{at("2019-07-17T01:00:00+00:00")},
+			want:    []string{""},
+		},
+	}
+	for _, test := range tests {
+		got := test.policy.Keep(now, test.created)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ERROR: %s: Keep() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGFSPolicyKeepDBSnapshots(t *testing.T) {
+	now := getTime("2019-07-17T18:00:00+00:00")
+	snapshots := dailyDBSnapshots(now, 3*365)
+	policy := GFSPolicy{Daily: 14, Weekly: 8, Monthly: 12, Yearly: 7}
+
+	kept := policy.KeepDBSnapshots(now, snapshots)
+	counts := map[string]int{}
+	for _, reason := range kept {
+		counts[reason]++
+	}
+	// Every one of the last 14 days is kept as a daily. The Mondays of
+	// the last 8 weeks are kept as weeklies, apart from the two in the
+	// last 14 days. The firsts of the last 12 months are monthlies,
+	// apart from July 1st, which is a weekly. The snapshots start in
+	// July 2016, so 2016 is kept by its first snapshot, and
+	// 2017, 2018 and 2019 by their firsts of January; 2019's is a
+	// monthly.
+	want := map[string]int{GFSDaily: 14, GFSWeekly: 6, GFSMonthly: 11, GFSYearly: 3}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("ERROR: KeepDBSnapshots() kept %v, want %v", counts, want)
+	}
+	for _, id := range []string{"snap-2019-07-17", "snap-2019-07-04", "snap-2019-06-24", "snap-2019-05-27", "snap-2018-08-01", "snap-2017-01-01", "snap-2016-07-18"} {
+		if _, ok := kept[id]; !ok {
+			t.Errorf("ERROR: KeepDBSnapshots() should have kept %s", id)
+		}
+	}
+	for _, id := range []string{"snap-2019-07-03", "snap-2019-05-20", "snap-2018-07-01", "snap-2016-07-19"} {
+		if reason, ok := kept[id]; ok {
+			t.Errorf("ERROR: KeepDBSnapshots() kept %s as %s", id, reason)
+		}
+	}
+}
+
+func TestFindDBSnapshotsToDeletePolicy(t *testing.T) {
+	now := getTime("2019-07-17T18:00:00+00:00")
+	snapshots := dailyDBSnapshots(now, 10)
+	logger, _ := zap.NewProduction()
+	r := RDSManualSnapshotClean{
+		DBInstanceIdentifier: "foo-db",
+		DryRun:               true,
+		// The policy takes the place of both of these.
+		ExpirationDate:     now,
+		MaxDBSnapshotCount: 1,
+		Logger:             logger,
+		Policy:             GFSPolicy{Daily: 3, Weekly: 2},
+		Now:                now,
+	}
+
+	toDelete, err := r.FindDBSnapshotsToDelete(snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range toDelete {
+		got = append(got, *s.DBSnapshotIdentifier)
+	}
+	var want []string
+	for day := 14; day >= 8; day-- {
+		// The 8th is last week's Monday.
+		if day != 8 {
+			want = append(want, fmt.Sprintf("snap-2019-07-%02d", day))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ERROR: FindDBSnapshotsToDelete() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,186 @@
+package rdsclean
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+)
+
+// InstanceSelector decides which database instances, or Aurora clusters,
+// we clean up manual snapshots for. An instance is selected if it matches
+// any one of the identifier patterns or tags, or if All is set.
+type InstanceSelector struct {
+	// IdentifierPatterns match instance identifiers using path.Match,
+	// so a plain identifier matches just that instance.
+	IdentifierPatterns []string
+	// Tags match instances with a tag set to the given value, or with
+	// the tag set at all if the value is empty.
+	Tags []*rds.Tag
+	// All selects every instance in the account and region.
+	All bool
+}
+
+// ParseTag turns "Key=Value" or "Key" into a tag for InstanceSelector.
+func ParseTag(rule string) (*rds.Tag, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("tag %q has no key", rule)
+	}
+	tag := &rds.Tag{Key: aws.String(parts[0]), Value: aws.String("")}
+	if len(parts) == 2 {
+		tag.Value = aws.String(parts[1])
+	}
+	return tag, nil
+}
+
+// Validate checks that the selector selects something and that the
+// identifier patterns are well formed.
+func (s InstanceSelector) Validate() error {
+	if !s.All && len(s.IdentifierPatterns) == 0 && len(s.Tags) == 0 {
+		return fmt.Errorf("no database instances selected")
+	}
+	for _, pattern := range s.IdentifierPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("identifier pattern %q is malformed: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether an instance is selected.
+func (s InstanceSelector) Match(instance *rds.DBInstance) bool {
+	return s.match(aws.StringValue(instance.DBInstanceIdentifier), instance.TagList)
+}
+
+// MatchCluster reports whether an Aurora cluster is selected. Clusters
+// are selected the same way as instances, by their own identifier and
+// tags.
+func (s InstanceSelector) MatchCluster(cluster *rds.DBCluster) bool {
+	return s.match(aws.StringValue(cluster.DBClusterIdentifier), cluster.TagList)
+}
+
+// match reports whether a database with the given identifier and tags is
+// selected.
+func (s InstanceSelector) match(identifier string, tags []*rds.Tag) bool {
+	if s.All {
+		return true
+	}
+
+	for _, pattern := range s.IdentifierPatterns {
+		// The patterns are checked by Validate, so we can ignore the
+		// error here.
+		if matched, _ := path.Match(pattern, identifier); matched {
+			return true
+		}
+	}
+
+	return matchTags(tags, s.Tags)
+}
+
+// SelectDBInstances returns every database instance the selector
+// selects.
+func SelectDBInstances(client rdsiface.RDSAPI, selector InstanceSelector) ([]*rds.DBInstance, error) {
+	var instances []*rds.DBInstance
+	err := client.DescribeDBInstancesPages(&rds.DescribeDBInstancesInput{},
+		func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+			for _, instance := range page.DBInstances {
+				if selector.Match(instance) {
+					instances = append(instances, instance)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// SelectDBClusters returns every Aurora cluster the selector selects.
+func SelectDBClusters(client rdsiface.RDSAPI, selector InstanceSelector) ([]*rds.DBCluster, error) {
+	var clusters []*rds.DBCluster
+	err := client.DescribeDBClustersPages(&rds.DescribeDBClustersInput{},
+		func(page *rds.DescribeDBClustersOutput, lastPage bool) bool {
+			for _, cluster := range page.DBClusters {
+				if selector.MatchCluster(cluster) {
+					clusters = append(clusters, cluster)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// RetentionSettings are how long we keep an instance's manual snapshots.
+type RetentionSettings struct {
+	RetentionDays      uint
+	MaxDBSnapshotCount uint
+}
+
+// RetentionTags name the tags an instance can carry to override the
+// default retention settings for its own snapshots. An empty name means
+// we don't look for that tag.
+type RetentionTags struct {
+	RetentionDays      string
+	MaxDBSnapshotCount string
+}
+
+// Settings returns the retention settings for an instance with the given
+// tags, starting from the defaults. A tag we're told to read that isn't
+// a whole number is an error, rather than something we guess at, since
+// guessing wrong would delete snapshots someone meant to keep.
+func (t RetentionTags) Settings(defaults RetentionSettings, tags []*rds.Tag) (RetentionSettings, error) {
+	settings := defaults
+	fields := []struct {
+		tag   string
+		value *uint
+	}{
+		{t.RetentionDays, &settings.RetentionDays},
+		{t.MaxDBSnapshotCount, &settings.MaxDBSnapshotCount},
+	}
+	for _, field := range fields {
+		if field.tag == "" {
+			continue
+		}
+		value, ok := tagValue(tags, field.tag)
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return defaults, fmt.Errorf("tag %s has value %q, which is not a whole number", field.tag, value)
+		}
+		*field.value = uint(parsed)
+	}
+	return settings, nil
+}
+
+// matchTags reports whether a set of tags matches any of the rules. A
+// rule with an empty value matches the tag set to anything.
+func matchTags(tags []*rds.Tag, rules []*rds.Tag) bool {
+	for _, rule := range rules {
+		value, ok := tagValue(tags, aws.StringValue(rule.Key))
+		if ok && (aws.StringValue(rule.Value) == "" || value == aws.StringValue(rule.Value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValue looks up a tag by key.
+func tagValue(tags []*rds.Tag, key string) (string, bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
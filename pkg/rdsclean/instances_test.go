@@ -0,0 +1,170 @@
+package rdsclean
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+)
+
+var fooDBInstance = &rds.DBInstance{
+	DBInstanceIdentifier: aws.String("foo-db"),
+	TagList: []*rds.Tag{
+		{Key: aws.String("SnapshotRetention"), Value: aws.String("14")},
+	},
+}
+
+var fooReplicaDBInstance = &rds.DBInstance{
+	DBInstanceIdentifier: aws.String("foo-db-replica"),
+}
+
+var barDBInstance = &rds.DBInstance{
+	DBInstanceIdentifier: aws.String("bar-db"),
+	TagList: []*rds.Tag{
+		{Key: aws.String("Environment"), Value: aws.String("staging")},
+		{Key: aws.String("SnapshotMaxCount"), Value: aws.String("many")},
+	},
+}
+
+// mockRDSClient serves DescribeDBInstances one instance per page.
+type mockRDSClient struct {
+	rdsiface.RDSAPI
+	instances []*rds.DBInstance
+}
+
+func (m *mockRDSClient) DescribeDBInstancesPages(input *rds.DescribeDBInstancesInput, fn func(*rds.DescribeDBInstancesOutput, bool) bool) error {
+	for i, instance := range m.instances {
+		page := &rds.DescribeDBInstancesOutput{DBInstances: []*rds.DBInstance{instance}}
+		if !fn(page, i == len(m.instances)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func identifiers(instances []*rds.DBInstance) []string {
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, aws.StringValue(instance.DBInstanceIdentifier))
+	}
+	return ids
+}
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    *rds.Tag
+		wantErr bool
+	}{
+		{"Retain=true", &rds.Tag{Key: aws.String("Retain"), Value: aws.String("true")}, false},
+		{"SnapshotRetention", &rds.Tag{Key: aws.String("SnapshotRetention"), Value: aws.String("")}, false},
+		{"Note=a=b", &rds.Tag{Key: aws.String("Note"), Value: aws.String("a=b")}, false},
+		{"=true", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseTag(test.rule)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ERROR: ParseTag(%q) error = %v, want error %v", test.rule, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ERROR: ParseTag(%q) = %v, want %v", test.rule, got, test.want)
+		}
+	}
+}
+
+func TestSelectDBInstances(t *testing.T) {
+	client := &mockRDSClient{instances: []*rds.DBInstance{fooDBInstance, fooReplicaDBInstance, barDBInstance}}
+	tests := []struct {
+		name     string
+		selector InstanceSelector
+		want     []string
+	}{
+		{
+			name:     "identifier",
+			selector: InstanceSelector{IdentifierPatterns: []string{"foo-db"}},
+			want:     []string{"foo-db"},
+		},
+		{
+			name:     "glob",
+			selector: InstanceSelector{IdentifierPatterns: []string{"foo-*"}},
+			want:     []string{"foo-db", "foo-db-replica"},
+		},
+		{
+			name:     "tag key",
+			selector: InstanceSelector{Tags: []*rds.Tag{{Key: aws.String("SnapshotRetention"), Value: aws.String("")}}},
+			want:     []string{"foo-db"},
+		},
+		{
+			name:     "tag value",
+			selector: InstanceSelector{Tags: []*rds.Tag{{Key: aws.String("Environment"), Value: aws.String("staging")}}},
+			want:     []string{"bar-db"},
+		},
+		{
+			name:     "wrong tag value",
+			selector: InstanceSelector{Tags: []*rds.Tag{{Key: aws.String("Environment"), Value: aws.String("prod")}}},
+			want:     nil,
+		},
+		{
+			name: "either",
+			selector: InstanceSelector{
+				IdentifierPatterns: []string{"*-replica"},
+				Tags:               []*rds.Tag{{Key: aws.String("Environment"), Value: aws.String("")}},
+			},
+			want: []string{"foo-db-replica", "bar-db"},
+		},
+		{
+			name:     "all",
+			selector: InstanceSelector{All: true},
+			want:     []string{"foo-db", "foo-db-replica", "bar-db"},
+		},
+	}
+	for _, test := range tests {
+		if err := test.selector.Validate(); err != nil {
+			t.Errorf("ERROR: %s: Validate() = %v", test.name, err)
+			continue
+		}
+		instances, err := SelectDBInstances(client, test.selector)
+		if err != nil {
+			t.Errorf("ERROR: %s: SelectDBInstances() error = %v", test.name, err)
+			continue
+		}
+		if got := identifiers(instances); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ERROR: %s: SelectDBInstances() = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	for _, selector := range []InstanceSelector{{}, {IdentifierPatterns: []string{"foo-["}}} {
+		if err := selector.Validate(); err == nil {
+			t.Errorf("ERROR: Validate(%+v) should have failed", selector)
+		}
+	}
+}
+
+func TestRetentionTagsSettings(t *testing.T) {
+	defaults := RetentionSettings{RetentionDays: 30, MaxDBSnapshotCount: 5}
+	retentionTags := RetentionTags{RetentionDays: "SnapshotRetention", MaxDBSnapshotCount: "SnapshotMaxCount"}
+	tests := []struct {
+		name          string
+		retentionTags RetentionTags
+		instance      *rds.DBInstance
+		want          RetentionSettings
+		wantErr       bool
+	}{
+		{"from tag", retentionTags, fooDBInstance, RetentionSettings{RetentionDays: 14, MaxDBSnapshotCount: 5}, false},
+		{"no tags", retentionTags, fooReplicaDBInstance, defaults, false},
+		{"not read", RetentionTags{}, fooDBInstance, defaults, false},
+		{"bad value", retentionTags, barDBInstance, defaults, true},
+	}
+	for _, test := range tests {
+		got, err := test.retentionTags.Settings(defaults, test.instance.TagList)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ERROR: %s: Settings() error = %v, want error %v", test.name, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("ERROR: %s: Settings() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
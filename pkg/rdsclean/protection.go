@@ -0,0 +1,255 @@
+package rdsclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"go.uber.org/zap"
+)
+
+// The reasons we protect a snapshot from deletion.
+const (
+	// ProtectedKeepTag is for snapshots with one of the KeepTags, such
+	// as legal holds.
+	ProtectedKeepTag = "keep-tag"
+	// ProtectedShared is for snapshots shared with other accounts,
+	// which may be restoring from them or copying them.
+	ProtectedShared = "shared"
+	// ProtectedCopySource is for snapshots that are being copied,
+	// since deleting one would fail the copy.
+	ProtectedCopySource = "copy-source"
+)
+
+// dbSnapshotStatusFailed is the status of a snapshot, or a copy of one,
+// that didn't work out.
+const dbSnapshotStatusFailed = "failed"
+
+// restoreAttribute is the snapshot attribute that lists the accounts a
+// snapshot is shared with.
+const restoreAttribute = "restore"
+
+// protectDBSnapshots moves the available snapshots we must never delete
+// out of Available and into Protected, so that they don't count toward
+// MaxDBSnapshotCount or a retention policy either.
+func (r *RDSManualSnapshotClean) protectDBSnapshots(manualDBSnapshots *ManualDBSnapshots) error {
+	sources, err := r.copySources(manualDBSnapshots)
+	if err != nil {
+		return err
+	}
+
+	var available []*rds.DBSnapshot
+	for _, s := range manualDBSnapshots.Available {
+		reason, err := r.protection(s, sources)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			available = append(available, s)
+			continue
+		}
+		r.Logger.Info("protecting db snapshot",
+			zap.String("db-snapshot-identifier", *s.DBSnapshotIdentifier),
+			zap.String("protection-reason", reason),
+		)
+		manualDBSnapshots.Protected[reason] = append(manualDBSnapshots.Protected[reason], s)
+	}
+	manualDBSnapshots.Available = available
+
+	return nil
+}
+
+// protection returns the reason a snapshot is protected, or "" if it
+// isn't. We check whether it's shared last, since that takes an API call
+// per snapshot.
+func (r *RDSManualSnapshotClean) protection(s *rds.DBSnapshot, sources map[string]bool) (string, error) {
+	if matchTags(s.TagList, r.KeepTags) {
+		return ProtectedKeepTag, nil
+	}
+	if sources[aws.StringValue(s.DBSnapshotIdentifier)] || sources[aws.StringValue(s.DBSnapshotArn)] {
+		return ProtectedCopySource, nil
+	}
+	shared, err := r.isShared(s)
+	if err != nil || !shared {
+		return "", err
+	}
+	return ProtectedShared, nil
+}
+
+// isShared reports whether a snapshot is shared with any other account,
+// or made public.
+func (r *RDSManualSnapshotClean) isShared(s *rds.DBSnapshot) (bool, error) {
+	output, err := r.RDSClient.DescribeDBSnapshotAttributes(&rds.DescribeDBSnapshotAttributesInput{
+		DBSnapshotIdentifier: s.DBSnapshotIdentifier,
+	})
+	if err != nil {
+		return false, err
+	}
+	if output.DBSnapshotAttributesResult == nil {
+		return false, nil
+	}
+	for _, attribute := range output.DBSnapshotAttributesResult.DBSnapshotAttributes {
+		if aws.StringValue(attribute.AttributeName) == restoreAttribute && len(attribute.AttributeValues) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// copySources returns the identifiers and ARNs of the snapshots that are
+// being copied, either within this region, where the copies are among
+// the snapshots that aren't available yet, or to one of the regions in
+// CopyDestinationClients. A copy to another region is only visible from
+// there.
+func (r *RDSManualSnapshotClean) copySources(manualDBSnapshots *ManualDBSnapshots) (map[string]bool, error) {
+	sources := map[string]bool{}
+	addCopy := func(s *rds.DBSnapshot) {
+		status := aws.StringValue(s.Status)
+		if s.SourceDBSnapshotIdentifier == nil || status == DBSnapshotStatusAvailable || status == dbSnapshotStatusFailed {
+			return
+		}
+		sources[*s.SourceDBSnapshotIdentifier] = true
+	}
+
+	for _, dbSnapshots := range manualDBSnapshots.Unavailable {
+		for _, s := range dbSnapshots {
+			addCopy(s)
+		}
+	}
+
+	for _, client := range r.CopyDestinationClients {
+		// Copies keep the instance identifier of the snapshot they're
+		// copied from.
+		input := &rds.DescribeDBSnapshotsInput{
+			DBInstanceIdentifier: aws.String(r.DBInstanceIdentifier),
+			SnapshotType:         aws.String("manual"),
+		}
+		err := client.DescribeDBSnapshotsPages(input,
+			func(page *rds.DescribeDBSnapshotsOutput, lastPage bool) bool {
+				for _, s := range page.DBSnapshots {
+					addCopy(s)
+				}
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sources, nil
+}
+
+// protectDBClusterSnapshots moves the available cluster snapshots we
+// must never delete out of Available and into Protected, the same way
+// protectDBSnapshots does for instance snapshots.
+func (r *RDSManualClusterSnapshotClean) protectDBClusterSnapshots(manualDBClusterSnapshots *ManualDBClusterSnapshots) error {
+	sources, err := r.copySources(manualDBClusterSnapshots)
+	if err != nil {
+		return err
+	}
+
+	var available []*rds.DBClusterSnapshot
+	for _, s := range manualDBClusterSnapshots.Available {
+		reason, err := r.protection(s, sources)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			available = append(available, s)
+			continue
+		}
+		r.Logger.Info("protecting db cluster snapshot",
+			zap.String("db-cluster-snapshot-identifier", *s.DBClusterSnapshotIdentifier),
+			zap.String("protection-reason", reason),
+		)
+		manualDBClusterSnapshots.Protected[reason] = append(manualDBClusterSnapshots.Protected[reason], s)
+	}
+	manualDBClusterSnapshots.Available = available
+
+	return nil
+}
+
+// protection returns the reason a cluster snapshot is protected, or "" if
+// it isn't. As with instance snapshots, we check whether it's shared last.
+func (r *RDSManualClusterSnapshotClean) protection(s *rds.DBClusterSnapshot, sources map[string]bool) (string, error) {
+	if matchTags(s.TagList, r.KeepTags) {
+		return ProtectedKeepTag, nil
+	}
+	if sources[aws.StringValue(s.DBClusterSnapshotIdentifier)] || sources[aws.StringValue(s.DBClusterSnapshotArn)] {
+		return ProtectedCopySource, nil
+	}
+	shared, err := r.isShared(s)
+	if err != nil || !shared {
+		return "", err
+	}
+	return ProtectedShared, nil
+}
+
+// isShared reports whether a cluster snapshot is shared with any other
+// account, or made public.
+func (r *RDSManualClusterSnapshotClean) isShared(s *rds.DBClusterSnapshot) (bool, error) {
+	output, err := r.RDSClient.DescribeDBClusterSnapshotAttributes(&rds.DescribeDBClusterSnapshotAttributesInput{
+		DBClusterSnapshotIdentifier: s.DBClusterSnapshotIdentifier,
+	})
+	if err != nil {
+		return false, err
+	}
+	if output.DBClusterSnapshotAttributesResult == nil {
+		return false, nil
+	}
+	for _, attribute := range output.DBClusterSnapshotAttributesResult.DBClusterSnapshotAttributes {
+		if aws.StringValue(attribute.AttributeName) == restoreAttribute && len(attribute.AttributeValues) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// copySources returns the ARNs of the cluster snapshots that are being
+// copied, either within this region or to one of the regions in
+// CopyDestinationClients, the same way as for instance snapshots.
+func (r *RDSManualClusterSnapshotClean) copySources(manualDBClusterSnapshots *ManualDBClusterSnapshots) (map[string]bool, error) {
+	sources := map[string]bool{}
+	addCopy := func(s *rds.DBClusterSnapshot) {
+		if s.SourceDBClusterSnapshotArn == nil || !clusterCopyInFlight(s) {
+			return
+		}
+		sources[*s.SourceDBClusterSnapshotArn] = true
+	}
+
+	for _, dbClusterSnapshots := range manualDBClusterSnapshots.Unavailable {
+		for _, s := range dbClusterSnapshots {
+			addCopy(s)
+		}
+	}
+
+	for _, client := range r.CopyDestinationClients {
+		// Copies keep the cluster identifier of the snapshot they're
+		// copied from.
+		input := &rds.DescribeDBClusterSnapshotsInput{
+			DBClusterIdentifier: aws.String(r.DBClusterIdentifier),
+			SnapshotType:        aws.String("manual"),
+		}
+		err := client.DescribeDBClusterSnapshotsPages(input,
+			func(page *rds.DescribeDBClusterSnapshotsOutput, lastPage bool) bool {
+				for _, s := range page.DBClusterSnapshots {
+					addCopy(s)
+				}
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sources, nil
+}
+
+// clusterCopyInFlight reports whether a cluster snapshot is still being
+// created or copied. RDS tells us how far along a cluster snapshot is as
+// well as its status, so we go by either.
+func clusterCopyInFlight(s *rds.DBClusterSnapshot) bool {
+	status := aws.StringValue(s.Status)
+	if status == dbSnapshotStatusFailed {
+		return false
+	}
+	return status != DBSnapshotStatusAvailable || (s.PercentProgress != nil && *s.PercentProgress < 100)
+}
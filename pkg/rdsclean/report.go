@@ -0,0 +1,38 @@
+package rdsclean
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Report is the record of a whole rds-snapshot-cleaner run across every
+// instance it selected.
+type Report struct {
+	DryRun    bool              `json:"dry_run"`
+	Instances []*InstanceReport `json:"instances"`
+}
+
+// InstanceReport records the retention settings we used for one
+// instance or Aurora cluster, the snapshots we picked to delete, the
+// snapshots we left alone because they weren't available or were
+// protected, and the error that stopped us, if there was one.
+// SnapshotCount only counts available snapshots that aren't protected.
+type InstanceReport struct {
+	DBInstanceIdentifier string              `json:"db_instance_identifier,omitempty"`
+	DBClusterIdentifier  string              `json:"db_cluster_identifier,omitempty"`
+	RetentionDays        uint                `json:"retention_days"`
+	MaxDBSnapshotCount   uint                `json:"max_snapshots"`
+	Policy               *GFSPolicy          `json:"policy,omitempty"`
+	SnapshotCount        int                 `json:"snapshot_count"`
+	Snapshots            []string            `json:"snapshots_to_delete"`
+	Unavailable          map[string][]string `json:"unavailable_snapshots,omitempty"`
+	Protected            map[string][]string `json:"protected_snapshots,omitempty"`
+	Error                string              `json:"error,omitempty"`
+}
+
+// WriteJSON writes the report out as a single JSON document.
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
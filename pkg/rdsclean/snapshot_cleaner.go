@@ -6,30 +6,58 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 	"go.uber.org/zap"
 )
 
 const (
 	// RFC8601 is the date/time format used by AWS.
 	RFC8601 = "2006-01-02T15:04:05-07:00"
+	// DBSnapshotStatusAvailable is the status of a snapshot that's
+	// finished being created or copied. RDS uses the same status for
+	// cluster snapshots.
+	DBSnapshotStatusAvailable = "available"
 )
 
 // RDSManualSnapshotClean defines parameters for cleaning manual RDS snapshots
-// based on ExpirationDate and MaxDBSnapshotCount
+// based on ExpirationDate and MaxDBSnapshotCount, or on Policy if it's set.
+// Snapshots with one of the KeepTags, shared with other accounts, or being
+// copied, here or to a region in CopyDestinationClients, are never deleted.
 type RDSManualSnapshotClean struct {
-	DBInstanceIdentifier string
-	DryRun               bool
-	ExpirationDate       time.Time
-	Logger               *zap.Logger
-	MaxDBSnapshotCount   uint
-	RDSClient            *rds.RDS
+	DBInstanceIdentifier   string
+	DryRun                 bool
+	ExpirationDate         time.Time
+	Logger                 *zap.Logger
+	MaxDBSnapshotCount     uint
+	Policy                 GFSPolicy
+	Now                    time.Time
+	KeepTags               []*rds.Tag
+	CopyDestinationClients []rdsiface.RDSAPI
+	RDSClient              rdsiface.RDSAPI
 }
 
-// FindDBSnapshotsToDelete will return a slice of DB snapshots to delete
+// FindDBSnapshotsToDelete will return a slice of DB snapshots to delete.
+// If there's a retention policy, it alone decides which snapshots we
+// keep, and ExpirationDate and MaxDBSnapshotCount are ignored.
 func (r *RDSManualSnapshotClean) FindDBSnapshotsToDelete(dbSnapshots []*rds.DBSnapshot) ([]*rds.DBSnapshot, error) {
 	var dbSnapshotsToDelete []*rds.DBSnapshot
 
 	sortDBSnapshots(dbSnapshots)
+	if !r.Policy.IsEmpty() {
+		kept := r.Policy.KeepDBSnapshots(r.Now, dbSnapshots)
+		for _, s := range dbSnapshots {
+			if reason, ok := kept[*s.DBSnapshotIdentifier]; ok {
+				r.Logger.Info("keeping db snapshot under retention policy",
+					zap.String("db-snapshot-identifier", *s.DBSnapshotIdentifier),
+					zap.String("retention-reason", reason),
+				)
+				continue
+			}
+			dbSnapshotsToDelete = append(dbSnapshotsToDelete, s)
+		}
+		return dbSnapshotsToDelete, nil
+	}
+
 	for i, s := range dbSnapshots {
 		// add snapshot to delete slice if past expiration
 		if s.SnapshotCreateTime.Before(r.ExpirationDate) {
@@ -47,9 +75,49 @@ func (r *RDSManualSnapshotClean) FindDBSnapshotsToDelete(dbSnapshots []*rds.DBSn
 	return dbSnapshotsToDelete, nil
 }
 
-// FindManualDBSnapshots returns a slice of available manual snapshots
-func (r *RDSManualSnapshotClean) FindManualDBSnapshots() ([]*rds.DBSnapshot, error) {
-	var manualDBSnapshots []*rds.DBSnapshot
+// ManualDBSnapshots are the manual snapshots of an instance, split into
+// the available ones that retention applies to, the ones that aren't
+// available, keyed by their status, and the available ones we protect,
+// keyed by the reason. A snapshot that's still being created or copied,
+// or that failed, isn't something we should count toward
+// MaxDBSnapshotCount or delete, but it's worth knowing about.
+type ManualDBSnapshots struct {
+	Available   []*rds.DBSnapshot
+	Unavailable map[string][]*rds.DBSnapshot
+	Protected   map[string][]*rds.DBSnapshot
+}
+
+// UnavailableIdentifiers lists the identifiers of the snapshots that
+// aren't available, keyed by their status.
+func (m *ManualDBSnapshots) UnavailableIdentifiers() map[string][]string {
+	return dbSnapshotIdentifiers(m.Unavailable)
+}
+
+// ProtectedIdentifiers lists the identifiers of the snapshots we
+// protect, keyed by the reason.
+func (m *ManualDBSnapshots) ProtectedIdentifiers() map[string][]string {
+	return dbSnapshotIdentifiers(m.Protected)
+}
+
+// dbSnapshotIdentifiers turns groups of snapshots into groups of their
+// identifiers.
+func dbSnapshotIdentifiers(groups map[string][]*rds.DBSnapshot) map[string][]string {
+	identifiers := map[string][]string{}
+	for key, dbSnapshots := range groups {
+		for _, s := range dbSnapshots {
+			identifiers[key] = append(identifiers[key], aws.StringValue(s.DBSnapshotIdentifier))
+		}
+	}
+	return identifiers
+}
+
+// ListManualDBSnapshots pages through the manual snapshots of the
+// instance, sorts them by status, and sets aside the ones we protect.
+func (r *RDSManualSnapshotClean) ListManualDBSnapshots() (*ManualDBSnapshots, error) {
+	manualDBSnapshots := &ManualDBSnapshots{
+		Unavailable: map[string][]*rds.DBSnapshot{},
+		Protected:   map[string][]*rds.DBSnapshot{},
+	}
 
 	input := &rds.DescribeDBSnapshotsInput{
 		DBInstanceIdentifier: aws.String(r.DBInstanceIdentifier),
@@ -58,18 +126,40 @@ func (r *RDSManualSnapshotClean) FindManualDBSnapshots() ([]*rds.DBSnapshot, err
 		SnapshotType:         aws.String("manual"),
 	}
 
-	res, err := r.RDSClient.DescribeDBSnapshots(input)
+	err := r.RDSClient.DescribeDBSnapshotsPages(input,
+		func(page *rds.DescribeDBSnapshotsOutput, lastPage bool) bool {
+			for _, s := range page.DBSnapshots {
+				status := aws.StringValue(s.Status)
+				// An available snapshot always has a creation time,
+				// but we sort on it, so we make sure.
+				if status == DBSnapshotStatusAvailable && s.SnapshotCreateTime != nil {
+					manualDBSnapshots.Available = append(manualDBSnapshots.Available, s)
+					continue
+				}
+				manualDBSnapshots.Unavailable[status] = append(manualDBSnapshots.Unavailable[status], s)
+			}
+			return true
+		})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, s := range res.DBSnapshots {
-		if s.Status == aws.String("available") || s.SnapshotCreateTime != nil {
-			manualDBSnapshots = append(manualDBSnapshots, s)
-		}
+	err = r.protectDBSnapshots(manualDBSnapshots)
+	if err != nil {
+		return nil, err
 	}
 
-	return manualDBSnapshots, err
+	return manualDBSnapshots, nil
+}
+
+// FindManualDBSnapshots returns a slice of available manual snapshots
+// that aren't protected
+func (r *RDSManualSnapshotClean) FindManualDBSnapshots() ([]*rds.DBSnapshot, error) {
+	manualDBSnapshots, err := r.ListManualDBSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	return manualDBSnapshots.Available, nil
 }
 
 // sortDBSnapshots sorts a slice of DB snapshots in chronological order(newest first) using SnapshotCreateTime
@@ -7,6 +7,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 	"go.uber.org/zap"
 )
 
@@ -94,3 +95,191 @@ func TestFindDBSnapshotsToDelete(t *testing.T) {
 	}
 
 }
+
+// mockRDSClientSnapshots serves DescribeDBSnapshots in pages of two, the
+// way RDS does when there are more than MaxRecords, and says the snapshots
+// in shared are shared with another account.
+type mockRDSClientSnapshots struct {
+	mockRDSClient
+	snapshots []*rds.DBSnapshot
+	shared    map[string]bool
+}
+
+func (m *mockRDSClientSnapshots) DescribeDBSnapshotAttributes(input *rds.DescribeDBSnapshotAttributesInput) (*rds.DescribeDBSnapshotAttributesOutput, error) {
+	attribute := &rds.DBSnapshotAttribute{AttributeName: aws.String("restore")}
+	if m.shared[aws.StringValue(input.DBSnapshotIdentifier)] {
+		attribute.AttributeValues = []*string{aws.String("123456789012")}
+	}
+	return &rds.DescribeDBSnapshotAttributesOutput{
+		DBSnapshotAttributesResult: &rds.DBSnapshotAttributesResult{
+			DBSnapshotIdentifier: input.DBSnapshotIdentifier,
+			DBSnapshotAttributes: []*rds.DBSnapshotAttribute{attribute},
+		},
+	}, nil
+}
+
+func (m *mockRDSClientSnapshots) DescribeDBSnapshotsPages(input *rds.DescribeDBSnapshotsInput, fn func(*rds.DescribeDBSnapshotsOutput, bool) bool) error {
+	var matching []*rds.DBSnapshot
+	for _, s := range m.snapshots {
+		if aws.StringValue(s.DBInstanceIdentifier) == aws.StringValue(input.DBInstanceIdentifier) {
+			matching = append(matching, s)
+		}
+	}
+	for i := 0; i < len(matching); i += 2 {
+		end := i + 2
+		if end > len(matching) {
+			end = len(matching)
+		}
+		page := &rds.DescribeDBSnapshotsOutput{DBSnapshots: matching[i:end]}
+		if !fn(page, end == len(matching)) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestListManualDBSnapshots(t *testing.T) {
+	creatingDBSnapshot := &rds.DBSnapshot{
+		DBInstanceIdentifier: aws.String("foo-db"),
+		DBSnapshotIdentifier: aws.String("creating-snapshot"),
+		SnapshotCreateTime:   aws.Time(getTime("2017-03-04T22:00:00+00:00")),
+		Status:               aws.String("creating"),
+	}
+	copyingDBSnapshot := &rds.DBSnapshot{
+		DBInstanceIdentifier: aws.String("foo-db"),
+		DBSnapshotIdentifier: aws.String("copying-snapshot"),
+		SnapshotCreateTime:   aws.Time(getTime("2017-03-04T23:00:00+00:00")),
+		Status:               aws.String("copying"),
+	}
+	failedDBSnapshot := &rds.DBSnapshot{
+		DBInstanceIdentifier: aws.String("foo-db"),
+		DBSnapshotIdentifier: aws.String("failed-snapshot"),
+		Status:               aws.String("failed"),
+	}
+	client := &mockRDSClientSnapshots{
+		snapshots: []*rds.DBSnapshot{
+			oldDBSnapshot,
+			creatingDBSnapshot,
+			{DBInstanceIdentifier: aws.String("bar-db"), DBSnapshotIdentifier: aws.String("bar-snapshot"), Status: aws.String("available")},
+			copyingDBSnapshot,
+			failedDBSnapshot,
+			newDBSnapshot,
+		},
+	}
+	logger, _ := zap.NewProduction()
+	r := RDSManualSnapshotClean{
+		DBInstanceIdentifier: "foo-db",
+		Logger:               logger,
+		RDSClient:            client,
+	}
+
+	got, err := r.ListManualDBSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAvailable := []*rds.DBSnapshot{oldDBSnapshot, newDBSnapshot}
+	if !reflect.DeepEqual(got.Available, wantAvailable) {
+		t.Errorf("ERROR: ListManualDBSnapshots().Available = %v, want %v", got.Available, wantAvailable)
+	}
+	wantUnavailable := map[string][]string{
+		"creating": {"creating-snapshot"},
+		"copying":  {"copying-snapshot"},
+		"failed":   {"failed-snapshot"},
+	}
+	if haveUnavailable := got.UnavailableIdentifiers(); !reflect.DeepEqual(haveUnavailable, wantUnavailable) {
+		t.Errorf("ERROR: ListManualDBSnapshots().UnavailableIdentifiers() = %v, want %v", haveUnavailable, wantUnavailable)
+	}
+
+	// Snapshots that aren't available mustn't count toward the maximum,
+	// or push available ones out.
+	available, err := r.FindManualDBSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ExpirationDate = getTime("2017-02-28T22:00:00+00:00")
+	r.MaxDBSnapshotCount = 2
+	toDelete, err := r.FindDBSnapshotsToDelete(available)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toDelete) != 0 {
+		t.Errorf("ERROR: FindDBSnapshotsToDelete() = %v, want none", toDelete)
+	}
+}
+
+func TestListManualDBSnapshotsProtected(t *testing.T) {
+	snapshot := func(id, status, created string) *rds.DBSnapshot {
+		return &rds.DBSnapshot{
+			DBInstanceIdentifier: aws.String("foo-db"),
+			DBSnapshotIdentifier: aws.String(id),
+			DBSnapshotArn:        aws.String("arn:aws:rds:us-west-2:123456789012:snapshot:" + id),
+			SnapshotCreateTime:   aws.Time(getTime(created)),
+			Status:               aws.String(status),
+		}
+	}
+	held := snapshot("held", "available", "2017-03-01T01:00:00+00:00")
+	held.TagList = []*rds.Tag{{Key: aws.String("Retain"), Value: aws.String("true")}}
+	notHeld := snapshot("not-held", "available", "2017-03-01T02:00:00+00:00")
+	notHeld.TagList = []*rds.Tag{{Key: aws.String("Retain"), Value: aws.String("false")}}
+	shared := snapshot("shared", "available", "2017-03-01T03:00:00+00:00")
+	copiedHere := snapshot("copied-here", "available", "2017-03-01T04:00:00+00:00")
+	copiedAway := snapshot("copied-away", "available", "2017-03-01T05:00:00+00:00")
+	copiedBefore := snapshot("copied-before", "available", "2017-03-01T06:00:00+00:00")
+	failedCopySource := snapshot("failed-copy-source", "available", "2017-03-01T07:00:00+00:00")
+	plain := snapshot("plain", "available", "2017-03-02T01:00:00+00:00")
+
+	copyHere := snapshot("copy-here", "copying", "2017-03-03T01:00:00+00:00")
+	copyHere.SourceDBSnapshotIdentifier = copiedHere.DBSnapshotArn
+	failedCopy := snapshot("failed-copy", "failed", "2017-03-03T02:00:00+00:00")
+	failedCopy.SourceDBSnapshotIdentifier = failedCopySource.DBSnapshotArn
+
+	copyAway := snapshot("copy-away", "pending", "2017-03-03T03:00:00+00:00")
+	copyAway.SourceDBSnapshotIdentifier = copiedAway.DBSnapshotArn
+	copyAway.SourceRegion = aws.String("us-west-2")
+	copyDone := snapshot("copy-done", "available", "2017-03-03T04:00:00+00:00")
+	copyDone.SourceDBSnapshotIdentifier = copiedBefore.DBSnapshotArn
+
+	logger, _ := zap.NewProduction()
+	r := RDSManualSnapshotClean{
+		DBInstanceIdentifier: "foo-db",
+		ExpirationDate:       getTime("2017-03-05T00:00:00+00:00"),
+		Logger:               logger,
+		KeepTags:             []*rds.Tag{{Key: aws.String("Retain"), Value: aws.String("true")}},
+		CopyDestinationClients: []rdsiface.RDSAPI{
+			&mockRDSClientSnapshots{snapshots: []*rds.DBSnapshot{copyAway, copyDone}},
+		},
+		RDSClient: &mockRDSClientSnapshots{
+			snapshots: []*rds.DBSnapshot{
+				held, notHeld, shared, copiedHere, copiedAway, copiedBefore,
+				failedCopySource, plain, copyHere, failedCopy,
+			},
+			shared: map[string]bool{"shared": true},
+		},
+	}
+
+	got, err := r.ListManualDBSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantProtected := map[string][]string{
+		ProtectedKeepTag:    {"held"},
+		ProtectedShared:     {"shared"},
+		ProtectedCopySource: {"copied-here", "copied-away"},
+	}
+	if haveProtected := got.ProtectedIdentifiers(); !reflect.DeepEqual(haveProtected, wantProtected) {
+		t.Errorf("ERROR: ListManualDBSnapshots().ProtectedIdentifiers() = %v, want %v", haveProtected, wantProtected)
+	}
+
+	// Protected snapshots don't count toward the maximum, so of the rest
+	// only the oldest is over it, and none of them is too old.
+	r.ExpirationDate = getTime("2017-02-28T00:00:00+00:00")
+	r.MaxDBSnapshotCount = 3
+	toDelete, err := r.FindDBSnapshotsToDelete(got.Available)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*rds.DBSnapshot{notHeld}
+	if !reflect.DeepEqual(toDelete, want) {
+		t.Errorf("ERROR: FindDBSnapshotsToDelete() = %v, want %v", toDelete, want)
+	}
+}